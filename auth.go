@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/davidmz/halley2/internal/channel"
+	"github.com/davidmz/halley2/internal/jwt"
+)
+
+var (
+	ErrInvalidSignature    = errors.New("invalid signature")
+	ErrChannelNotAllowed   = errors.New("channel not allowed")
+	ErrPublishNotAllowed   = errors.New("publishing is not allowed")
+	ErrMemberMismatch      = errors.New("member does not match token")
+	ErrSignVersion         = errors.New("signature version not allowed")
+	ErrTimestampOutOfRange = errors.New("timestamp out of range")
+	ErrPostJWTNotAllowed   = errors.New("publishing with JWT is not allowed")
+)
+
+// Причина отказа в доступе для метрик
+func authFailureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrTokenExpired):
+		return "token_expired"
+	case errors.Is(err, ErrTokenWrongSite):
+		return "token_wrong_site"
+	case errors.Is(err, ErrTokenInvalid):
+		return "token_invalid"
+	case errors.Is(err, ErrInvalidSignature):
+		return "invalid_signature"
+	case errors.Is(err, ErrChannelNotAllowed), errors.Is(err, ErrPublishNotAllowed):
+		return "channel_not_allowed"
+	case errors.Is(err, ErrMemberMismatch):
+		return "member_mismatch"
+	case errors.Is(err, ErrSignVersion), errors.Is(err, ErrPostJWTNotAllowed):
+		return "sign_version"
+	case errors.Is(err, ErrTimestampOutOfRange):
+		return "timestamp"
+	}
+	return "other"
+}
+
+// Проверяет заголовок "Authorization: Bearer ADMIN_SECRET" служебных
+// запросов. Без admin_secret в конфиге они запрещены.
+func adminAuthorized(conf *Conf, r *http.Request) bool {
+	if conf.AdminSecret == "" {
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	given := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(conf.AdminSecret)) == 1
+}
+
+// Токен из запроса: JWT передаётся как есть, собственный токен halley2 —
+// в base64. Тип определяется по тексту до декодирования: в двоичном
+// собственном токене могут встретиться любые байты, в том числе точки.
+type Token struct {
+	Bytes   []byte // текст JWT или декодированный собственный токен
+	JWT     bool
+	Expires time.Time // срок действия, заполняется checkSiteToken
+}
+
+func (t *Token) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	if jwt.IsJWT([]byte(s)) {
+		*t = Token{Bytes: []byte(s), JWT: true}
+		return nil
+	}
+	x, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	*t = Token{Bytes: x}
+	return nil
+}
+
+// Проверяет токен, предъявленный сайту, и запоминает срок его действия.
+// Для JWT возвращает его claims, для собственного токена halley2 — nil.
+func checkSiteToken(conf *Conf, site *SiteConf, token *Token) (*jwt.Claims, error) {
+	if !token.JWT {
+		if err := CheckToken(token.Bytes, conf.Secret, site.Name); err != nil {
+			return nil, err
+		}
+		token.Expires = time.Unix(int64(binary.LittleEndian.Uint64(token.Bytes[:8])), 0)
+		return nil, nil
+	}
+
+	claims, err := jwt.Parse(token.Bytes, site.JWTKeys(), time.Now())
+	if err == jwt.ErrExpired {
+		return nil, ErrTokenExpired
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTokenInvalid, err)
+	}
+	if claims.Site != site.Name {
+		return nil, ErrTokenWrongSite
+	}
+	token.Expires = time.Unix(claims.Expires, 0)
+	return claims, nil
+}
+
+// Разрешает ли один из шаблонов доступ к каналу (или шаблону) name
+func patternsAllow(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if channel.PatternCovers(p, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/davidmz/halley2/internal/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNativeTokenRoundTrip(t *testing.T) {
+	keys, err := ParseKeyring("wqTnnp8jgTnw5fNIjgT0kw==")
+	require.NoError(t, err)
+
+	// в имени сайта есть точка, так что в двоичном токене часто
+	// оказывается ровно две точки, как в JWT
+	site := &SiteConf{Name: "example.com"}
+	conf := &Conf{Secret: keys, Sites: []*SiteConf{site}}
+
+	for i := 0; i < 1000; i++ {
+		// разный срок действия даёт разные подписи
+		raw, err := NewToken(keys, site.Name, time.Minute+time.Duration(i)*time.Second)
+		require.NoError(t, err)
+		b64 := base64.StdEncoding.EncodeToString(raw)
+
+		var fromJSON Token
+		b, _ := json.Marshal(b64)
+		require.NoError(t, json.Unmarshal(b, &fromJSON))
+		require.False(t, fromJSON.JWT)
+		claims, err := checkSiteToken(conf, site, &fromJSON)
+		require.NoError(t, err, "token %x", raw)
+		require.Nil(t, claims)
+		// срок действия токена нужен, чтобы помнить nonce запроса
+		require.WithinDuration(t, time.Now().Add(time.Minute+time.Duration(i)*time.Second), fromJSON.Expires, 2*time.Second)
+
+		fromQuery, err := decodeTokenParam(b64)
+		require.NoError(t, err)
+		_, err = checkSiteToken(conf, site, &fromQuery)
+		require.NoError(t, err, "token %x", raw)
+	}
+}
+
+func makeJWT(secret []byte, claims *jwt.Claims) []byte {
+	enc := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	s := enc(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + enc(claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(s))
+	return []byte(s + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+func TestPostJWT(t *testing.T) {
+	keys, err := ParseKeyring("3q3PZr2nJVmXQ9bNQk1lGw==")
+	require.NoError(t, err)
+	site := &SiteConf{Name: "example.com", JWTSecret: keys}
+	conf := &Conf{Sites: []*SiteConf{site}}
+
+	exp := time.Now().Add(time.Hour).Unix()
+	token := Token{JWT: true, Bytes: makeJWT(keys.Primary().Secret, &jwt.Claims{
+		Site:    site.Name,
+		Publish: []string{"news.*"},
+		Expires: exp,
+	})}
+	post := &PostRequest{ChanName: "news.1", Token: token}
+	batch := &PostBatchRequest{Items: []*BatchItem{{"news.1", nil}}, Token: token}
+
+	// по умолчанию JWT не заменяет подпись post_secret
+	require.ErrorIs(t, post.Check(conf, site), ErrPostJWTNotAllowed)
+	require.ErrorIs(t, batch.Check(conf, site), ErrPostJWTNotAllowed)
+
+	site.PostJWT = true
+	require.NoError(t, post.Check(conf, site))
+	require.NoError(t, batch.Check(conf, site))
+	require.Equal(t, exp, post.Token.Expires.Unix())
+
+	post.ChanName = "chat.1"
+	require.ErrorIs(t, post.Check(conf, site), ErrChannelNotAllowed)
+}
@@ -1,39 +1,103 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"encoding/base64"
 	"flag"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/davidmz/halley2/internal/channel"
+	"github.com/davidmz/halley2/internal/jwt"
 	"github.com/davidmz/logg"
 	"github.com/vaughan0/go-ini"
 )
 
 type Conf struct {
+	FileName    string
 	ListenAddr  string
 	ListenMemc  string
 	LogLevel    logg.Level
 	ChannelSize int
 	MsgLifetime time.Duration
-	Secret      []byte
+	DataDir     string
+	Secret      Keyring
 	Sites       []*SiteConf
-	NSessions   uint32
+	Peers       []string
+	PeerSecret  []byte
+	// Номер узла кластера, различается на всех узлах
+	NodeIndex   int
+	Broker      string
+	RedisAddr   string
+	RedisBus    string
+	AdminSecret string
+	// Сколько ждать завершения работы при остановке
+	ShutdownTimeout time.Duration
 }
 
 type SiteConf struct {
 	Name       string
-	Secret     []byte
-	PostSecret []byte
+	Secret     Keyring
+	PostSecret Keyring
+	// Время жизни токенов, выдаваемых для сайта
+	TokenLifetime time.Duration
+	// Версии подписи запросов на публикацию, которые принимает сайт
+	PostSignVersions map[int]bool
+	// Префиксы каналов, в которые клиенты могут публиковать сообщения
+	// через WebSocket; "*" — любые каналы
+	ClientPublish []string
+	Retention     []*RetentionRule
+	// Ключи для проверки JWT, выписанных для сайта
+	JWTSecret    Keyring
+	JWTPublicKey []ed25519.PublicKey
+	// Можно ли публиковать через /post, /post-batch и memcache по JWT без
+	// подписи post_secret
+	PostJWT bool
+	// Источники, из которых браузеры могут открывать WebSocket;
+	// nil — любые
+	AllowedOrigins OriginList
+	// Размер исходящей очереди WebSocket-сессии и что делать при её
+	// переполнении
+	QueueSize    int
+	SlowConsumer string
+	// CORS для REST-запросов; nil CORSOrigins — CORS выключен
+	CORSOrigins OriginList
+	CORSMethods string
+	CORSHeaders string
+	CORSMaxAge  time.Duration
+}
+
+// Можно ли открыть WebSocket со страницы origin. Запросы без Origin
+// приходят не из браузера и разрешены всегда.
+func (s *SiteConf) OriginAllowed(origin string) bool {
+	return origin == "" || s.AllowedOrigins == nil || s.AllowedOrigins.Allows(origin)
+}
+
+// Действующие ключи для проверки JWT
+func (s *SiteConf) JWTKeys() *jwt.Keys {
+	keys := &jwt.Keys{Ed25519: s.JWTPublicKey}
+	if len(s.JWTSecret) > 0 {
+		keys.HMAC = s.JWTSecret.Active()
+	}
+	return keys
+}
+
+func (s *SiteConf) CanClientPublish(chanName string) bool {
+	for _, p := range s.ClientPublish {
+		if p == "*" || strings.HasPrefix(chanName, p) {
+			return true
+		}
+	}
+	return false
 }
 
 func ReadConf() (*Conf, error) {
 	var (
 		showHelp     bool
 		confFileName string
-		ok           bool
 	)
 
 	flag.StringVar(&confFileName, "c", "", "config file name")
@@ -50,12 +114,19 @@ func ReadConf() (*Conf, error) {
 		os.Exit(1)
 	}
 
+	return LoadConf(confFileName)
+}
+
+// Читает конфигурацию из файла
+func LoadConf(confFileName string) (*Conf, error) {
+	var ok bool
+
 	confFile, err := ini.LoadFile(confFileName)
 	if err != nil {
 		return nil, err
 	}
 
-	conf := &Conf{}
+	conf := &Conf{FileName: confFileName}
 
 	baseSection := confFile[""]
 	delete(confFile, "")
@@ -86,30 +157,269 @@ func ReadConf() (*Conf, error) {
 		conf.MsgLifetime = x
 	}
 
-	if x, err := base64.StdEncoding.DecodeString(baseSection["secret"]); err != nil {
-		return nil, err
+	conf.DataDir = baseSection["data_dir"]
+
+	if x, err := ParseKeyring(baseSection["secret"]); err != nil {
+		return nil, fmt.Errorf("secret: %v", err)
 	} else {
 		conf.Secret = x
 	}
 
+	for _, p := range strings.Split(baseSection["peers"], ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			conf.Peers = append(conf.Peers, p)
+		}
+	}
+
+	if x, ok := baseSection["node_index"]; ok {
+		if x, err := strconv.Atoi(x); err != nil {
+			return nil, fmt.Errorf("node_index: %v", err)
+		} else if x < 0 || x >= channel.MaxNodes {
+			return nil, fmt.Errorf("node_index must be from 0 to %d", channel.MaxNodes-1)
+		} else {
+			conf.NodeIndex = x
+		}
+	}
+
+	if x, ok := baseSection["cluster_secret"]; !ok {
+		conf.PeerSecret = conf.Secret.Primary().Secret
+	} else if x, err := base64.StdEncoding.DecodeString(x); err != nil {
+		return nil, err
+	} else {
+		conf.PeerSecret = x
+	}
+
+	switch conf.Broker = baseSection["broker"]; conf.Broker {
+	case "":
+		conf.Broker = "memory"
+	case "memory":
+	case "redis":
+		if conf.RedisAddr, ok = baseSection["redis_addr"]; !ok {
+			return nil, fmt.Errorf("redis_addr not setted")
+		}
+		if conf.RedisBus, ok = baseSection["redis_bus"]; !ok {
+			conf.RedisBus = "halley2"
+		}
+	default:
+		return nil, fmt.Errorf("unknown broker %q", conf.Broker)
+	}
+
+	conf.AdminSecret = baseSection["admin_secret"]
+
+	if x, ok := baseSection["shutdown_timeout"]; !ok {
+		conf.ShutdownTimeout = DefaultShutdownTimeout
+	} else if x, err := time.ParseDuration(x); err != nil {
+		return nil, fmt.Errorf("shutdown_timeout: %v", err)
+	} else if x < 0 {
+		return nil, fmt.Errorf("negative shutdown_timeout")
+	} else {
+		conf.ShutdownTimeout = x
+	}
+
 	// Sites
 	for name, sect := range confFile {
 		s := &SiteConf{Name: name}
 
-		if x, err := base64.StdEncoding.DecodeString(sect["secret"]); err != nil {
-			return nil, err
+		if x, err := ParseKeyring(sect["secret"]); err != nil {
+			return nil, fmt.Errorf("[%s] secret: %v", name, err)
 		} else {
 			s.Secret = x
 		}
 
-		if x, err := base64.StdEncoding.DecodeString(sect["post_secret"]); err != nil {
-			return nil, err
+		if x, err := ParseKeyring(sect["post_secret"]); err != nil {
+			return nil, fmt.Errorf("[%s] post_secret: %v", name, err)
 		} else {
 			s.PostSecret = x
 		}
 
+		if x, ok := sect["token_lifetime"]; !ok {
+			s.TokenLifetime = DefaultTokenLifetime
+		} else if x, err := time.ParseDuration(x); err != nil {
+			return nil, fmt.Errorf("[%s] token_lifetime: %v", name, err)
+		} else if x < time.Second {
+			return nil, fmt.Errorf("[%s] token_lifetime must be at least 1s", name)
+		} else {
+			s.TokenLifetime = x
+		}
+
+		s.PostSignVersions = make(map[int]bool)
+		if x, ok := sect["post_signatures"]; !ok {
+			s.PostSignVersions[PostSignV1] = true
+			s.PostSignVersions[PostSignV2] = true
+		} else {
+			for _, v := range strings.Split(x, ",") {
+				switch v = strings.TrimSpace(v); v {
+				case "v1":
+					s.PostSignVersions[PostSignV1] = true
+				case "v2":
+					s.PostSignVersions[PostSignV2] = true
+				case "":
+				default:
+					return nil, fmt.Errorf("[%s] post_signatures: unknown version %q", name, v)
+				}
+			}
+		}
+
+		if x, ok := sect["jwt_secret"]; ok {
+			if x, err := ParseKeyring(x); err != nil {
+				return nil, fmt.Errorf("[%s] jwt_secret: %v", name, err)
+			} else {
+				s.JWTSecret = x
+			}
+		}
+
+		if x, ok := sect["jwt_public_key"]; ok {
+			if x, err := base64.StdEncoding.DecodeString(x); err != nil {
+				return nil, err
+			} else if len(x) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("[%s] jwt_public_key must be a raw Ed25519 public key", name)
+			} else {
+				s.JWTPublicKey = append(s.JWTPublicKey, ed25519.PublicKey(x))
+			}
+		}
+
+		switch x := sect["post_jwt"]; x {
+		case "on":
+			s.PostJWT = true
+		case "off", "":
+		default:
+			return nil, fmt.Errorf("[%s] post_jwt must be on or off, got %q", name, x)
+		}
+
+		for _, p := range strings.Split(sect["client_publish"], ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				s.ClientPublish = append(s.ClientPublish, p)
+			}
+		}
+
+		if x, ok := sect["allowed_origins"]; ok {
+			if x, err := ParseOriginList(x); err != nil {
+				return nil, fmt.Errorf("[%s] allowed_origins: %v", name, err)
+			} else {
+				// пустое значение запрещает все источники
+				s.AllowedOrigins = append(OriginList{}, x...)
+			}
+		}
+
+		if x, ok := sect["queue_size"]; !ok {
+			s.QueueSize = DefaultQueueSize
+		} else if x, err := strconv.ParseUint(x, 10, 31); err != nil {
+			return nil, fmt.Errorf("[%s] queue_size: %v", name, err)
+		} else if x == 0 {
+			return nil, fmt.Errorf("[%s] queue_size must be positive", name)
+		} else {
+			s.QueueSize = int(x)
+		}
+
+		switch s.SlowConsumer = sect["slow_consumer"]; s.SlowConsumer {
+		case "":
+			s.SlowConsumer = SlowConsumerDisconnect
+		case SlowConsumerDropOldest, SlowConsumerDropNewest, SlowConsumerDisconnect:
+		default:
+			return nil, fmt.Errorf("[%s] unknown slow_consumer policy %q", name, s.SlowConsumer)
+		}
+
+		if x, ok := sect["cors_origins"]; ok {
+			if x, err := ParseOriginList(x); err != nil {
+				return nil, fmt.Errorf("[%s] cors_origins: %v", name, err)
+			} else {
+				s.CORSOrigins = append(OriginList{}, x...)
+			}
+		}
+
+		if x, ok := sect["cors_methods"]; !ok {
+			s.CORSMethods = DefaultCORSMethods
+		} else {
+			s.CORSMethods = normalizeList(strings.ToUpper(x))
+		}
+
+		if x, ok := sect["cors_headers"]; !ok {
+			s.CORSHeaders = DefaultCORSHeaders
+		} else {
+			s.CORSHeaders = normalizeList(x)
+		}
+
+		if x, ok := sect["cors_max_age"]; ok {
+			if x, err := time.ParseDuration(x); err != nil {
+				return nil, fmt.Errorf("[%s] cors_max_age: %v", name, err)
+			} else if x < 0 {
+				return nil, fmt.Errorf("[%s] negative cors_max_age", name)
+			} else {
+				s.CORSMaxAge = x
+			}
+		}
+
+		if x, err := parseRetention(sect); err != nil {
+			return nil, fmt.Errorf("[%s] %v", name, err)
+		} else {
+			s.Retention = x
+		}
+
 		conf.Sites = append(conf.Sites, s)
 	}
 
 	return conf, nil
 }
+
+// Приводит список через запятую к виду "a, b, c"
+func normalizeList(s string) string {
+	var items []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			items = append(items, p)
+		}
+	}
+	return strings.Join(items, ", ")
+}
+
+// Параметры, которые нельзя поменять без перезапуска и которые
+// отличаются в c и old
+func (c *Conf) RestartRequired(old *Conf) []string {
+	var changed []string
+	for _, p := range []struct {
+		name     string
+		new, old interface{}
+	}{
+		{"listen", c.ListenAddr, old.ListenAddr},
+		{"listen_memcache", c.ListenMemc, old.ListenMemc},
+		{"data_dir", c.DataDir, old.DataDir},
+		{"peers", strings.Join(c.Peers, ","), strings.Join(old.Peers, ",")},
+		{"node_index", c.NodeIndex, old.NodeIndex},
+		{"cluster_secret", string(c.PeerSecret), string(old.PeerSecret)},
+		{"broker", c.Broker, old.Broker},
+		{"redis_addr", c.RedisAddr, old.RedisAddr},
+		{"redis_bus", c.RedisBus, old.RedisBus},
+	} {
+		if p.new != p.old {
+			changed = append(changed, p.name)
+		}
+	}
+	return changed
+}
+
+// Выведенные из оборота ключи в виде "параметр id", их можно убрать из
+// конфигурации
+func (c *Conf) RetiredKeys() []string {
+	var keys []string
+	add := func(param string, k Keyring) {
+		for _, id := range k.Retired() {
+			keys = append(keys, param+" "+id)
+		}
+	}
+	add("secret", c.Secret)
+	for _, s := range c.Sites {
+		add("["+s.Name+"] secret", s.Secret)
+		add("["+s.Name+"] post_secret", s.PostSecret)
+		add("["+s.Name+"] jwt_secret", s.JWTSecret)
+	}
+	return keys
+}
+
+func (c *Conf) Site(name string) *SiteConf {
+	for _, s := range c.Sites {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/davidmz/logg"
+)
+
+// Текущая конфигурация и корневой логгер. При перечитывании конфигурации
+// (SIGHUP) заменяются вместе и атомарно, поэтому обработчики должны брать
+// их отсюда при каждом запросе, а не запоминать.
+type ConfStore struct {
+	v atomic.Value // *confState
+}
+
+type confState struct {
+	conf *Conf
+	log  *logg.Logger
+}
+
+func NewConfStore(conf *Conf, log *logg.Logger) *ConfStore {
+	s := new(ConfStore)
+	s.Set(conf, log)
+	return s
+}
+
+func (s *ConfStore) Get() *Conf { return s.v.Load().(*confState).conf }
+
+func (s *ConfStore) Log() *logg.Logger { return s.v.Load().(*confState).log }
+
+func (s *ConfStore) Set(conf *Conf, log *logg.Logger) {
+	s.v.Store(&confState{conf: conf, log: log})
+}
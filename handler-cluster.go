@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/davidmz/halley2/internal/channel"
+	"github.com/davidmz/halley2/internal/cluster"
+	"github.com/davidmz/halley2/internal/npool"
+)
+
+type HandlerCluster struct {
+	Confs *ConfStore      `inject:""`
+	Pool  npool.NamedPool `inject:""`
+	Node  *cluster.Node   `inject:""`
+}
+
+func (h *HandlerCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	envs, err := h.Node.Decode(r)
+	if err != nil {
+		h.Confs.Log().DEBUG("Bad cluster request from %v: %v", r.RemoteAddr, err)
+		sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	conf := h.Confs.Get()
+	for _, env := range envs {
+		if conf.Site(env.Site) == nil {
+			// остальные сообщения пачки не должны пропасть из-за одного
+			h.Confs.Log().DEBUG("Cluster message for unknown site %q", env.Site)
+			continue
+		}
+		if channel.OrdNode(env.Ord) == conf.NodeIndex {
+			h.Confs.Log().WARN("Message %d from %v has our node_index %d, node_index must differ on every node",
+				env.Ord, r.RemoteAddr, conf.NodeIndex)
+		}
+
+		ch := h.Pool.Get(channel.ChanKey{
+			Site: env.Site,
+			Name: env.Channel,
+		}).(*channel.Channel)
+
+		if err := ch.AddRemoteMessage(env.Message()); err != nil {
+			h.Confs.Log().ERROR("Can not write message to log: %v", err)
+		}
+	}
+
+	sendOK(w, &PostResponse{Status: statusOK})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/davidmz/halley2/internal/broker"
+	"github.com/davidmz/halley2/internal/channel"
+	"github.com/gorilla/context"
+)
+
+type HandlerHistory struct {
+	Confs   *ConfStore    `inject:""`
+	Broker  broker.Broker `inject:""`
+	Metrics *Metrics      `inject:""`
+}
+
+const HistoryDefaultLimit = 100
+
+// Список сообщений в ответах /history и /poll
+type MessageList struct {
+	Epoch    channel.Epoch      `json:"epoch"`
+	Messages []*channel.Message `json:"messages"`
+}
+
+func (h *HandlerHistory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := h.Confs.Log().ChildWithPrefix("HISTORY from " + r.RemoteAddr)
+
+	site := context.Get(r, "site").(*SiteConf)
+
+	cmd, err := subscribeFromQuery(r)
+	if err != nil {
+		log.DEBUG("Bad request: %v", err)
+		sendJSON(w, http.StatusBadRequest, &PostResponse{Status: statusErr, Message: err.Error()})
+		return
+	}
+
+	if channel.IsPattern(cmd.Channel) {
+		sendJSON(w, http.StatusBadRequest, &PostResponse{Status: statusErr, Message: "patterns are not supported"})
+		return
+	}
+
+	q := r.URL.Query()
+
+	var before channel.Ord
+	if x := q.Get("before"); x != "" {
+		n, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			sendJSON(w, http.StatusBadRequest, &PostResponse{Status: statusErr, Message: "invalid before value"})
+			return
+		}
+		before = channel.Ord(n)
+	}
+
+	limit := HistoryDefaultLimit
+	if x := q.Get("limit"); x != "" {
+		n, err := strconv.ParseUint(x, 10, 31)
+		if err != nil || n == 0 {
+			sendJSON(w, http.StatusBadRequest, &PostResponse{Status: statusErr, Message: "invalid limit value"})
+			return
+		}
+		limit = int(n)
+	}
+
+	if err := cmd.Check(h.Confs.Get(), site); err != nil {
+		log.DEBUG("History of %q rejected: %v", cmd.Channel, err)
+		h.Metrics.AuthFailed(site.Name, err)
+		sendJSON(w, http.StatusForbidden, &PostResponse{
+			Status:  statusErr,
+			Message: fmt.Sprintf("%s: %v", cmd.Channel, err),
+		})
+		return
+	}
+
+	msgs := h.Broker.History(channel.ChanKey{
+		Site: site.Name,
+		Name: cmd.Channel,
+	}, cmd.After, before, limit)
+
+	sendOK(w, &MessageList{
+		Epoch:    channel.CurrentEpoch(),
+		Messages: append([]*channel.Message{}, msgs...),
+	})
+}
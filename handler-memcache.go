@@ -1,43 +1,64 @@
 package main
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
+	"sync"
 
+	"github.com/davidmz/halley2/internal/broker"
 	"github.com/davidmz/halley2/internal/channel"
-	"github.com/davidmz/halley2/internal/npool"
-	"github.com/davidmz/logg"
 	"github.com/davidmz/memcache/simplemmc"
 )
 
+const (
+	tokenKeyPrefix = "token:"
+	batchKeyPrefix = "batch:"
+)
+
 type HandlerMemc struct {
-	Conf *Conf           `inject:""`
-	Log  *logg.Logger    `inject:""`
-	Pool npool.NamedPool `inject:""`
+	Confs     *ConfStore `inject:""`
+	Publisher *Publisher `inject:""`
+	Metrics   *Metrics   `inject:""`
+
+	lk       sync.RWMutex
+	closing  bool
+	inFlight sync.WaitGroup
 }
 
+var ErrShuttingDown = errors.New("server is shutting down")
+
 func (h *HandlerMemc) Get(key string) ([]byte, error) {
-	h.Log.TRACE("mmc get %q", key)
+	conf := h.Confs.Get()
+	h.Confs.Log().TRACE("mmc get %q", key)
+
+	// token:SITE_NAME
+	if strings.HasPrefix(key, tokenKeyPrefix) {
+		site := conf.Site(strings.TrimPrefix(key, tokenKeyPrefix))
+		if site == nil {
+			return nil, simplemmc.ErrNotFound
+		}
 
-	switch key {
-	case "token":
-		b, _ := json.Marshal(&struct {
-			Token   []byte `json:"token"`
-			Expires int64  `json:"expires"`
-		}{
-			Expires: TOKEN_EXP_TIME,
-			Token:   NewToken(h.Conf.Secret),
-		})
+		resp, err := NewTokenResponse(conf.Secret, site)
+		if err != nil {
+			h.Confs.Log().ERROR("Can not issue token: secret: %v", err)
+			return nil, err
+		}
+		b, _ := json.Marshal(resp)
 
 		return b, nil
+	}
 
+	switch key {
 	case "nextOrd":
 		b, _ := json.Marshal(&struct {
-			NextOrd channel.Ord `json:"next_ord"`
+			NextOrd channel.Ord   `json:"next_ord"`
+			Epoch   channel.Epoch `json:"epoch"`
 		}{
 			NextOrd: channel.NextOrd(),
+			Epoch:   channel.CurrentEpoch(),
 		})
 
 		return b, nil
@@ -48,16 +69,28 @@ func (h *HandlerMemc) Get(key string) ([]byte, error) {
 
 func (h *HandlerMemc) Set(key string, data []byte, mode simplemmc.SetMode) error {
 
-	h.Log.TRACE("mmc set %q", key)
+	conf, log := h.Confs.Get(), h.Confs.Log()
+	log.TRACE("mmc set %q", key)
 
-	var site *SiteConf
-	for _, st := range h.Conf.Sites {
-		if st.Name == key {
-			site = st
-			break
+	h.lk.RLock()
+	if h.closing {
+		h.lk.RUnlock()
+		return ErrShuttingDown
+	}
+	h.inFlight.Add(1)
+	h.lk.RUnlock()
+	defer h.inFlight.Done()
+
+	// batch:SITE_NAME
+	if strings.HasPrefix(key, batchKeyPrefix) {
+		site := conf.Site(strings.TrimPrefix(key, batchKeyPrefix))
+		if site == nil {
+			return errors.New("site not found")
 		}
+		return h.setBatch(conf, site, data)
 	}
 
+	site := conf.Site(key)
 	if site == nil {
 		return errors.New("site not found")
 	}
@@ -67,26 +100,82 @@ func (h *HandlerMemc) Set(key string, data []byte, mode simplemmc.SetMode) error
 		return err
 	}
 
-	if !CheckToken(pReq.Token, h.Conf.Secret) {
-		return errors.New("Invalid token")
+	if err := pReq.Check(conf, site); err != nil {
+		h.Metrics.AuthFailed(site.Name, err)
+		return err
+	}
+
+	if _, err := h.Publisher.Publish(site, pReq.ChanName, pReq.MessageBody, pReq.Nonce, pReq.Token.Expires); err == ErrDuplicate {
+		log.DEBUG("Duplicate request, nonce %q", pReq.Nonce)
+		return nil
+	} else if err == broker.ErrInvalidChannel {
+		return errors.New("Invalid channel name")
+	} else if err != nil {
+		log.ERROR("Can not publish message: %v", err)
+		return errors.New("Can not publish message")
 	}
 
-	mac := hmac.New(sha256.New, site.PostSecret)
-	mac.Write(pReq.Token)
-	sign := mac.Sum(nil)
+	return nil
+}
+
+// Публикует пакет сообщений. Номера сообщений по memcache не вернуть,
+// поэтому при ошибках в отдельных сообщениях возвращается ошибка со
+// списком их индексов; остальные сообщения пакета при этом опубликованы.
+func (h *HandlerMemc) setBatch(conf *Conf, site *SiteConf, data []byte) error {
+	log := h.Confs.Log()
 
-	if !hmac.Equal(sign, pReq.Signature) {
-		return errors.New("Invalid signature")
+	req := new(PostBatchRequest)
+	if err := json.Unmarshal(data, req); err != nil {
+		return err
 	}
 
-	ch := h.Pool.Get(channel.ChanKey{
-		Site: site.Name,
-		Name: pReq.ChanName,
-	}).(*channel.Channel)
+	if err := req.Check(conf, site); err != nil {
+		if err != ErrEmptyBatch && err != ErrBatchTooLarge {
+			h.Metrics.AuthFailed(site.Name, err)
+		}
+		return err
+	}
 
-	ch.AddMessage(pReq.MessageBody)
+	results, err := h.Publisher.PublishBatch(site, req.Items, req.Nonce, req.Token.Expires)
+	if err == ErrDuplicate {
+		log.DEBUG("Duplicate request, nonce %q", req.Nonce)
+		return nil
+	}
 
+	var failed []string
+	for i, res := range results {
+		if res.Err != nil {
+			if res.Err != broker.ErrInvalidChannel {
+				log.ERROR("Can not publish message to %q: %v", req.Items[i].ChanName, res.Err)
+			}
+			failed = append(failed, fmt.Sprintf("%d: %s", i, publishErrorText(res.Err)))
+		}
+	}
+	if failed != nil {
+		return fmt.Errorf("items not published: %s", strings.Join(failed, "; "))
+	}
 	return nil
 }
 
 func (h *HandlerMemc) Del(key string) error { return nil }
+
+// Перестаёт принимать новые сообщения и ждёт завершения начатых
+// публикаций (или истечения ctx)
+func (h *HandlerMemc) Drain(ctx context.Context) error {
+	h.lk.Lock()
+	h.closing = true
+	h.lk.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
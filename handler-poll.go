@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/davidmz/halley2/internal/broker"
+	"github.com/davidmz/halley2/internal/channel"
+	"github.com/gorilla/context"
+)
+
+type HandlerPoll struct {
+	Confs   *ConfStore    `inject:""`
+	Broker  broker.Broker `inject:""`
+	Metrics *Metrics      `inject:""`
+}
+
+const (
+	PollDefaultTimeout = 30 * time.Second
+	PollMaxTimeout     = 2 * time.Minute
+	// Сколько ждать остальных сообщений после прихода первого
+	PollBatchDelay = 50 * time.Millisecond
+)
+
+type pollReceiver struct {
+	lk     sync.Mutex
+	msgs   []*channel.Message
+	notify chan struct{}
+}
+
+func (r *pollReceiver) ReceiveMessage(m *channel.Message) {
+	r.lk.Lock()
+	r.msgs = append(r.msgs, m)
+	r.lk.Unlock()
+
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (h *HandlerPoll) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := h.Confs.Log().ChildWithPrefix("POLL from " + r.RemoteAddr)
+
+	log.TRACE("New poll request")
+	defer log.TRACE("End of poll request")
+
+	site := context.Get(r, "site").(*SiteConf)
+
+	cmds, timeout, err := pollFromQuery(r)
+	if err != nil {
+		log.DEBUG("Bad request: %v", err)
+		sendJSON(w, http.StatusBadRequest, &PostResponse{Status: statusErr, Message: err.Error()})
+		return
+	}
+
+	for _, cmd := range cmds {
+		if err := cmd.Check(h.Confs.Get(), site); err != nil {
+			log.DEBUG("Subscription to %q rejected: %v", cmd.Channel, err)
+			h.Metrics.AuthFailed(site.Name, err)
+			sendJSON(w, http.StatusForbidden, &PostResponse{
+				Status:  statusErr,
+				Message: fmt.Sprintf("%s: %v", cmd.Channel, err),
+			})
+			return
+		}
+	}
+
+	rcv := &pollReceiver{notify: make(chan struct{}, 1)}
+
+	for _, cmd := range cmds {
+		key := channel.ChanKey{Site: site.Name, Name: cmd.Channel}
+		h.Broker.Subscribe(key, rcv, cmd.After, channel.Presence{})
+		defer h.Broker.Unsubscribe(key, rcv)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-rcv.notify:
+		time.Sleep(PollBatchDelay)
+	case <-timer.C:
+	case <-r.Context().Done():
+		return
+	}
+
+	rcv.lk.Lock()
+	msgs := append([]*channel.Message{}, rcv.msgs...)
+	rcv.lk.Unlock()
+
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Ord < msgs[j].Ord })
+
+	sendOK(w, &MessageList{
+		Epoch:    channel.CurrentEpoch(),
+		Messages: msgs,
+	})
+
+	for _, m := range msgs {
+		h.Metrics.MessageWritten(site.Name, m)
+	}
+}
+
+// Параметры запроса: один token и after на все каналы, пары channel/auth
+// на каждый канал
+func pollFromQuery(r *http.Request) ([]*CmdSubscribe, time.Duration, error) {
+	q := r.URL.Query()
+
+	names, auths := q["channel"], q["auth"]
+	if len(names) == 0 {
+		return nil, 0, fmt.Errorf("no channels requested")
+	}
+	if len(names) != len(auths) {
+		return nil, 0, fmt.Errorf("each channel must have its own auth")
+	}
+
+	var after channel.Ord
+	if x := q.Get("after"); x != "" {
+		n, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid after value")
+		}
+		after = channel.Ord(n)
+	}
+
+	timeout := PollDefaultTimeout
+	if x := q.Get("timeout"); x != "" {
+		n, err := strconv.ParseUint(x, 10, 32)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid timeout value")
+		}
+		timeout = time.Duration(n) * time.Second
+		if timeout > PollMaxTimeout {
+			timeout = PollMaxTimeout
+		}
+	}
+
+	token, err := decodeTokenParam(q.Get("token"))
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid token encoding")
+	}
+
+	cmds := make([]*CmdSubscribe, len(names))
+	for i, name := range names {
+		auth, err := decodeB64Param(auths[i])
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid auth encoding")
+		}
+		cmds[i] = &CmdSubscribe{
+			Channel: name,
+			After:   after,
+			Token:   token,
+			Auth:    auth,
+		}
+	}
+
+	return cmds, timeout, nil
+}
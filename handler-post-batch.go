@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/davidmz/halley2/internal/broker"
+	"github.com/davidmz/halley2/internal/channel"
+	"github.com/gorilla/context"
+)
+
+// Наибольшее число сообщений в пакете
+const PostBatchMaxItems = 1000
+
+var (
+	ErrEmptyBatch    = errors.New("no items")
+	ErrBatchTooLarge = fmt.Errorf("too many items, max is %d", PostBatchMaxItems)
+)
+
+type HandlerPostBatch struct {
+	Confs     *ConfStore `inject:""`
+	Publisher *Publisher `inject:""`
+	Metrics   *Metrics   `inject:""`
+}
+
+// Пакет сообщений под одной подписью. Поля те же, что в PostRequest.
+type PostBatchRequest struct {
+	Items       []*BatchItem `json:"items"`
+	Token       Token        `json:"token"`
+	Signature   []byte       `json:"auth"`
+	SignVersion int          `json:"sign_version"`
+	Timestamp   int64        `json:"timestamp"`
+	Nonce       string       `json:"nonce"`
+}
+
+// Строка, подписываемая по версии 2: вместо канала и хэша сообщения —
+// хэш списка пар «хэш канала, хэш сообщения». Хэши имеют фиксированную
+// длину, так что границы полей и сообщений нельзя сдвинуть.
+func (p *PostBatchRequest) signingStringV2(site string) []byte {
+	items := sha256.New()
+	for _, item := range p.Items {
+		ch, msg := sha256.Sum256([]byte(item.ChanName)), sha256.Sum256(item.MessageBody)
+		items.Write(ch[:])
+		items.Write(msg[:])
+	}
+	s := fmt.Sprintf("v2-batch\n%s\n%x\n%d\n%s",
+		site, items.Sum(nil), p.Timestamp,
+		base64.StdEncoding.EncodeToString(p.Token.Bytes),
+	)
+	if p.Nonce != "" {
+		s += "\n" + p.Nonce
+	}
+	return []byte(s)
+}
+
+// Проверяет размер пакета, токен и подпись. JWT принимается, только если
+// сайт это разрешает (post_jwt), и все каналы пакета должны быть разрешены
+// для публикации.
+func (p *PostBatchRequest) Check(conf *Conf, site *SiteConf) error {
+	if len(p.Items) == 0 {
+		return ErrEmptyBatch
+	}
+	if len(p.Items) > PostBatchMaxItems {
+		return ErrBatchTooLarge
+	}
+
+	claims, err := checkSiteToken(conf, site, &p.Token)
+	if err != nil {
+		return err
+	}
+
+	if claims != nil {
+		if !site.PostJWT {
+			return ErrPostJWTNotAllowed
+		}
+		for _, item := range p.Items {
+			if !patternsAllow(claims.Publish, item.ChanName) {
+				return fmt.Errorf("%w: %q", ErrChannelNotAllowed, item.ChanName)
+			}
+		}
+		return nil
+	}
+
+	return checkPostSignature(site, p.SignVersion, p.Timestamp, p.Token.Bytes, p.Signature, p.signingStringV2)
+}
+
+type BatchItemResponse struct {
+	Ord   channel.Ord `json:"ord,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+type PostBatchResponse struct {
+	PostResponse
+	Results []*BatchItemResponse `json:"results,omitempty"`
+}
+
+// Текст ошибки публикации для клиента
+func publishErrorText(err error) string {
+	if err == broker.ErrInvalidChannel {
+		return "Invalid channel name"
+	}
+	return "Can not publish message"
+}
+
+func (h *HandlerPostBatch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := h.Confs.Log().ChildWithPrefix("POST batch from " + r.RemoteAddr)
+
+	log.TRACE("New post batch request")
+	defer log.TRACE("End of post batch request")
+
+	defer r.Body.Close()
+
+	site := context.Get(r, "site").(*SiteConf)
+
+	req := &PostBatchRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		log.DEBUG("Cannot decode json: %v", err)
+		sendJSON(w, http.StatusBadRequest, &PostResponse{
+			Status:  statusErr,
+			Message: fmt.Sprintf("Cannot decode json: %v", err),
+		})
+		return
+	}
+
+	if err := req.Check(h.Confs.Get(), site); err != nil {
+		log.DEBUG("Post batch rejected: %v (token %v)", err, req.Token.Bytes)
+		if err != ErrEmptyBatch && err != ErrBatchTooLarge {
+			h.Metrics.AuthFailed(site.Name, err)
+		}
+		sendJSON(w, http.StatusBadRequest, &PostResponse{
+			Status:  statusErr,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	results, err := h.Publisher.PublishBatch(site, req.Items, req.Nonce, req.Token.Expires)
+	if err == ErrDuplicate {
+		log.DEBUG("Duplicate request, nonce %q", req.Nonce)
+		sendOK(w, &PostResponse{Status: statusOK, Message: "duplicate"})
+		return
+	}
+
+	resp := &PostBatchResponse{
+		PostResponse: PostResponse{Status: statusOK},
+		Results:      make([]*BatchItemResponse, len(results)),
+	}
+	for i, res := range results {
+		resp.Results[i] = &BatchItemResponse{Ord: res.Ord}
+		if res.Err != nil {
+			if res.Err != broker.ErrInvalidChannel {
+				log.ERROR("Can not publish message to %q: %v", req.Items[i].ChanName, res.Err)
+			}
+			resp.Results[i].Error = publishErrorText(res.Err)
+		}
+	}
+
+	sendOK(w, resp)
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchSigningStringBoundaries(t *testing.T) {
+	m1, m2 := json.RawMessage(`1`), json.RawMessage(`2`)
+	two := &PostBatchRequest{Items: []*BatchItem{{"a", m1}, {"b", m2}}, Timestamp: 1}
+	// склейка двух сообщений в одно с тем же телом второго
+	one := &PostBatchRequest{Items: []*BatchItem{
+		{fmt.Sprintf("a\n%x\nb", sha256.Sum256(m1)), m2},
+	}, Timestamp: 1}
+
+	require.NotEqual(t, two.signingStringV2("site"), one.signingStringV2("site"))
+}
@@ -3,27 +3,104 @@ package main
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
-	"github.com/davidmz/halley2/internal/channel"
-	"github.com/davidmz/halley2/internal/npool"
-	"github.com/davidmz/logg"
+	"github.com/davidmz/halley2/internal/broker"
 	"github.com/gorilla/context"
 )
 
 type HandlerPost struct {
-	Conf *Conf           `inject:""`
-	Log  *logg.Logger    `inject:""`
-	Pool npool.NamedPool `inject:""`
+	Confs     *ConfStore `inject:""`
+	Publisher *Publisher `inject:""`
+	Metrics   *Metrics   `inject:""`
 }
 
 type PostRequest struct {
 	ChanName    string          `json:"channel"`
-	Token       []byte          `json:"token"`
+	Token       Token           `json:"token"`
 	Signature   []byte          `json:"auth"`
 	MessageBody json.RawMessage `json:"message"`
+	// Версия подписи: 0 или 1 — подписывается только токен, 2 — сайт, канал,
+	// хэш сообщения, время и токен
+	SignVersion int   `json:"sign_version"`
+	Timestamp   int64 `json:"timestamp"`
+	// Одноразовый идентификатор запроса для защиты от повторов
+	Nonce string `json:"nonce"`
+}
+
+const (
+	PostSignV1 = 1
+	PostSignV2 = 2
+)
+
+// Строка, подписываемая по версии 2
+func (p *PostRequest) signingStringV2(site string) []byte {
+	digest := sha256.Sum256(p.MessageBody)
+	s := fmt.Sprintf("v2\n%s\n%s\n%x\n%d\n%s",
+		site, p.ChanName, digest, p.Timestamp,
+		base64.StdEncoding.EncodeToString(p.Token.Bytes),
+	)
+	if p.Nonce != "" {
+		s += "\n" + p.Nonce
+	}
+	return []byte(s)
+}
+
+// Проверяет токен и подпись запроса на публикацию. Для JWT подпись не нужна,
+// если сайт это разрешает (post_jwt), а канал должен быть разрешён для
+// публикации в claims.
+func (p *PostRequest) Check(conf *Conf, site *SiteConf) error {
+	claims, err := checkSiteToken(conf, site, &p.Token)
+	if err != nil {
+		return err
+	}
+
+	if claims != nil {
+		if !site.PostJWT {
+			return ErrPostJWTNotAllowed
+		}
+		if !patternsAllow(claims.Publish, p.ChanName) {
+			return ErrChannelNotAllowed
+		}
+		return nil
+	}
+
+	return checkPostSignature(site, p.SignVersion, p.Timestamp, p.Token.Bytes, p.Signature, p.signingStringV2)
+}
+
+// Проверяет подпись запроса на публикацию версии version (0 — версия 1).
+// signingV2 возвращает строку, подписываемую по версии 2.
+func checkPostSignature(site *SiteConf, version int, timestamp int64, token, signature []byte, signingV2 func(site string) []byte) error {
+	if version == 0 {
+		version = PostSignV1
+	}
+	if !site.PostSignVersions[version] {
+		return fmt.Errorf("%w: v%d", ErrSignVersion, version)
+	}
+
+	var signed []byte
+	switch version {
+	case PostSignV1:
+		signed = token
+	case PostSignV2:
+		if d := time.Since(time.Unix(timestamp, 0)); d > site.TokenLifetime || d < -site.TokenLifetime {
+			return ErrTimestampOutOfRange
+		}
+		signed = signingV2(site.Name)
+	}
+
+	if !site.PostSecret.Verify(func(secret []byte) bool {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	}) {
+		return ErrInvalidSignature
+	}
+	return nil
 }
 
 const (
@@ -37,7 +114,7 @@ type PostResponse struct {
 }
 
 func (h *HandlerPost) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log := h.Log.ChildWithPrefix("POST from " + r.RemoteAddr)
+	log := h.Confs.Log().ChildWithPrefix("POST from " + r.RemoteAddr)
 
 	log.TRACE("New post request")
 	defer log.TRACE("End of post request")
@@ -56,35 +133,35 @@ func (h *HandlerPost) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !CheckToken(req.Token, h.Conf.Secret) {
-		log.DEBUG("Invalid token: %v", req.Token)
-		w.WriteHeader(http.StatusBadRequest)
+	if err := req.Check(h.Confs.Get(), site); err != nil {
+		log.DEBUG("Post rejected: %v (token %v)", err, req.Token.Bytes)
+		h.Metrics.AuthFailed(site.Name, err)
 		sendJSON(w, http.StatusBadRequest, &PostResponse{
 			Status:  statusErr,
-			Message: fmt.Sprintf("Invalid token"),
+			Message: err.Error(),
 		})
 		return
 	}
 
-	mac := hmac.New(sha256.New, site.PostSecret)
-	mac.Write(req.Token)
-	sign := mac.Sum(nil)
-
-	if !hmac.Equal(sign, req.Signature) {
-		log.DEBUG("Invalid signature: %v", req.Token)
+	if _, err := h.Publisher.Publish(site, req.ChanName, req.MessageBody, req.Nonce, req.Token.Expires); err == ErrDuplicate {
+		log.DEBUG("Duplicate request, nonce %q", req.Nonce)
+		sendOK(w, &PostResponse{Status: statusOK, Message: "duplicate"})
+		return
+	} else if err == broker.ErrInvalidChannel {
+		log.DEBUG("Invalid channel name: %q", req.ChanName)
 		sendJSON(w, http.StatusBadRequest, &PostResponse{
 			Status:  statusErr,
-			Message: fmt.Sprintf("Invalid signature"),
+			Message: "Invalid channel name",
+		})
+		return
+	} else if err != nil {
+		log.ERROR("Can not publish message: %v", err)
+		sendJSON(w, http.StatusInternalServerError, &PostResponse{
+			Status:  statusErr,
+			Message: "Can not publish message",
 		})
 		return
 	}
 
-	ch := h.Pool.Get(channel.ChanKey{
-		Site: site.Name,
-		Name: req.ChanName,
-	}).(*channel.Channel)
-
-	ch.AddMessage(req.MessageBody)
-
 	sendOK(w, &PostResponse{Status: statusOK})
 }
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/davidmz/halley2/internal/broker"
+	"github.com/davidmz/halley2/internal/channel"
+	"github.com/davidmz/halley2/internal/jwt"
+	"github.com/gorilla/context"
+)
+
+type HandlerSSE struct {
+	Confs   *ConfStore    `inject:""`
+	Broker  broker.Broker `inject:""`
+	Stats   *Stats        `inject:""`
+	Metrics *Metrics      `inject:""`
+}
+
+// Копит сообщения для потока. Если новых сообщений накопилось больше size,
+// поток закрывается: клиент переподключится с Last-Event-ID и получит
+// пропущенное из буфера канала. Сообщения из буфера, переданные при
+// подписке, в size не входят, иначе длинная история закрывала бы поток
+// при каждом переподключении.
+type sseReceiver struct {
+	lk       sync.Mutex
+	msgs     []*channel.Message
+	replayed int // сколько в msgs сообщений из буфера
+	size     int
+	overflow bool
+	notify   chan struct{}
+}
+
+func (r *sseReceiver) ReceiveMessage(m *channel.Message) {
+	r.lk.Lock()
+	if !m.Replayed && len(r.msgs) >= r.size+r.replayed {
+		r.overflow = true
+	} else if !r.overflow {
+		r.msgs = append(r.msgs, m)
+		if m.Replayed {
+			r.replayed++
+		}
+	}
+	r.lk.Unlock()
+
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (r *sseReceiver) take() (msgs []*channel.Message, overflow bool) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	msgs, r.msgs = r.msgs, nil
+	r.replayed = 0
+	return msgs, r.overflow
+}
+
+func (h *HandlerSSE) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := h.Confs.Log().ChildWithPrefix("SSE from " + r.RemoteAddr)
+
+	log.TRACE("New sse request")
+	defer log.TRACE("End of sse request")
+
+	site := context.Get(r, "site").(*SiteConf)
+
+	cmd, err := subscribeFromQuery(r)
+	if err != nil {
+		log.DEBUG("Bad request: %v", err)
+		sendJSON(w, http.StatusBadRequest, &PostResponse{Status: statusErr, Message: err.Error()})
+		return
+	}
+
+	if err := cmd.Check(h.Confs.Get(), site); err != nil {
+		log.DEBUG("Subscription rejected: %v", err)
+		h.Metrics.AuthFailed(site.Name, err)
+		sendJSON(w, http.StatusForbidden, &PostResponse{Status: statusErr, Message: err.Error()})
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendJSON(w, http.StatusInternalServerError, &PostResponse{Status: statusErr, Message: "Streaming is not supported"})
+		return
+	}
+
+	// Поток живёт дольше ReadTimeout и WriteTimeout сервера: срок чтения
+	// снимается, а срок записи продлевается перед каждой записью, так что
+	// поток обрывается, только если клиент перестал принимать данные
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	armWrite := func() { rc.SetWriteDeadline(time.Now().Add(KeepAliveTimeout)) }
+	armWrite()
+
+	siteStats := h.Stats.Site(site.Name)
+	atomic.AddInt64(&siteStats.Sessions, 1)
+	defer atomic.AddInt64(&siteStats.Sessions, -1)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	b, _ := json.Marshal(&SubscribeResult{Epoch: channel.CurrentEpoch()})
+	fmt.Fprintf(w, "event: subscribed\ndata: %s\n\n", b)
+	flusher.Flush()
+
+	rcv := &sseReceiver{
+		size:   site.QueueSize,
+		notify: make(chan struct{}, 1),
+	}
+
+	key := channel.ChanKey{Site: site.Name, Name: cmd.Channel}
+	h.Broker.Subscribe(key, rcv, cmd.After, channel.Presence{})
+	defer h.Broker.Unsubscribe(key, rcv)
+
+	ticker := time.NewTicker(PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rcv.notify:
+			msgs, overflow := rcv.take()
+			armWrite()
+			for _, m := range msgs {
+				b, _ := json.Marshal(m)
+				if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", m.Ord, b); err != nil {
+					log.DEBUG("SSE write error %v", err)
+					return
+				}
+				h.Metrics.MessageWritten(site.Name, m)
+			}
+			flusher.Flush()
+			if overflow {
+				log.DEBUG("SSE client is too slow, closing stream")
+				siteStats := h.Stats.Site(site.Name)
+				atomic.AddUint64(&siteStats.Dropped, 1)
+				atomic.AddUint64(&siteStats.SlowDisconnects, 1)
+				return
+			}
+		case <-ticker.C:
+			if h.Confs.Get().Site(site.Name) == nil {
+				log.DEBUG("Site %q removed from config, closing stream", site.Name)
+				return
+			}
+			armWrite()
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				log.DEBUG("SSE write error %v", err)
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Параметры подписки из строки запроса. Номер последнего полученного
+// сообщения берётся из заголовка Last-Event-ID, если он есть.
+func subscribeFromQuery(r *http.Request) (*CmdSubscribe, error) {
+	q := r.URL.Query()
+	cmd := &CmdSubscribe{Channel: q.Get("channel")}
+
+	after := q.Get("after")
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		after = id
+	}
+	if after != "" {
+		x, err := strconv.ParseInt(after, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid after value")
+		}
+		cmd.After = channel.Ord(x)
+	}
+
+	var err error
+	if cmd.Token, err = decodeTokenParam(q.Get("token")); err != nil {
+		return nil, fmt.Errorf("invalid token encoding")
+	}
+	if cmd.Auth, err = decodeB64Param(q.Get("auth")); err != nil {
+		return nil, fmt.Errorf("invalid auth encoding")
+	}
+
+	return cmd, nil
+}
+
+// Разбирает токен из параметра запроса: JWT берётся как есть, собственный
+// токен декодируется из base64
+func decodeTokenParam(s string) (Token, error) {
+	if jwt.IsJWT([]byte(s)) {
+		return Token{Bytes: []byte(s), JWT: true}, nil
+	}
+	b, err := decodeB64Param(s)
+	return Token{Bytes: b}, err
+}
+
+// Декодирует base64 в обычном или URL-безопасном варианте
+func decodeB64Param(s string) ([]byte, error) {
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return b, nil
+	}
+	return base64.RawURLEncoding.DecodeString(s)
+}
@@ -3,30 +3,111 @@ package main
 import (
 	"net/http"
 	"runtime"
-	"sync/atomic"
+	"sort"
+	"strconv"
 	"time"
 
-	"github.com/davidmz/logg"
+	"github.com/davidmz/halley2/internal/channel"
+	"github.com/davidmz/halley2/internal/npool"
 )
 
 var startTime = time.Now()
 
+// Наибольшее значение параметра top
+const StatsMaxTop = 1000
+
 type HandlerStats struct {
-	Log  *logg.Logger `inject:""`
-	Conf *Conf        `inject:""`
+	Confs *ConfStore      `inject:""`
+	Stats *Stats          `inject:""`
+	Pool  npool.NamedPool `inject:""`
+}
+
+type ChanStatsResponse struct {
+	Site        string `json:"site"`
+	Channel     string `json:"channel"`
+	Messages    uint64 `json:"messages"`
+	Delivered   uint64 `json:"delivered"`
+	Subscribers int    `json:"subscribers"`
+	RingLength  int    `json:"ring_length"`
 }
 
 func (h *HandlerStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(h.Confs.Get(), r) {
+		h.Confs.Log().DEBUG("Unauthorized stats request from %v", r.RemoteAddr)
+		sendJSON(w, http.StatusForbidden, &PostResponse{
+			Status:  statusErr,
+			Message: "Forbidden",
+		})
+		return
+	}
+
+	top := 0
+	if x := r.URL.Query().Get("top"); x != "" {
+		n, err := strconv.Atoi(x)
+		if err != nil || n < 0 {
+			sendJSON(w, http.StatusBadRequest, &PostResponse{
+				Status:  statusErr,
+				Message: "Invalid top value",
+			})
+			return
+		}
+		if n > StatsMaxTop {
+			n = StatsMaxTop
+		}
+		top = n
+	}
+
 	mem := &runtime.MemStats{}
 	runtime.ReadMemStats(mem)
 
+	var chans []*channel.ChanInfo
+	sites := h.Stats.Report(h.Pool, func(info *channel.ChanInfo) {
+		if top > 0 {
+			chans = append(chans, info)
+		}
+	})
+
+	var topChans []*ChanStatsResponse
+	if top > 0 {
+		// самые нагруженные — по числу сообщений, затем по числу подписчиков
+		sort.Slice(chans, func(i, j int) bool {
+			if chans[i].Messages != chans[j].Messages {
+				return chans[i].Messages > chans[j].Messages
+			}
+			return chans[i].Subscribers > chans[j].Subscribers
+		})
+		if len(chans) > top {
+			chans = chans[:top]
+		}
+		topChans = make([]*ChanStatsResponse, len(chans))
+		for i, info := range chans {
+			topChans[i] = &ChanStatsResponse{
+				Site:        info.Key.Site,
+				Channel:     info.Key.Name,
+				Messages:    info.Messages,
+				Delivered:   info.Delivered,
+				Subscribers: info.Subscribers,
+				RingLength:  info.RingLength,
+			}
+		}
+	}
+
+	var sessions int64
+	for _, ss := range sites {
+		sessions += ss.Sessions
+	}
+
 	sendOK(w, &struct {
-		Uptime   string `json:"uptime"`
-		Memory   uint64 `json:"memory"`
-		Sessions uint32 `json:"sessions"`
+		Uptime      string                        `json:"uptime"`
+		Memory      uint64                        `json:"memory"`
+		Sessions    int64                         `json:"sessions"`
+		Sites       map[string]*SiteStatsResponse `json:"sites"`
+		TopChannels []*ChanStatsResponse          `json:"top_channels,omitempty"`
 	}{
 		time.Since(startTime).String(),
 		mem.Alloc,
-		atomic.LoadUint32(&h.Conf.NSessions),
+		sessions,
+		sites,
+		topChans,
 	})
 }
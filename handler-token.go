@@ -5,49 +5,95 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"net/http"
 	"time"
 
-	"github.com/davidmz/logg"
+	"github.com/gorilla/context"
 )
 
 type HandlerToken struct {
-	Conf *Conf        `inject:""`
-	Log  *logg.Logger `inject:""`
+	Confs *ConfStore `inject:""`
 }
 
-const (
-	TOKEN_EXP_TIME = 120
+const DefaultTokenLifetime = 120 * time.Second
+
+var (
+	ErrTokenInvalid   = errors.New("invalid token")
+	ErrTokenExpired   = errors.New("token expired")
+	ErrTokenWrongSite = errors.New("token issued for another site")
 )
 
+type TokenResponse struct {
+	Token   []byte `json:"token"`
+	Expires int64  `json:"expires"`
+}
+
+func NewTokenResponse(keys Keyring, site *SiteConf) (*TokenResponse, error) {
+	token, err := NewToken(keys, site.Name, site.TokenLifetime)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenResponse{
+		Expires: int64(site.TokenLifetime / time.Second),
+		Token:   token,
+	}, nil
+}
+
 func (h *HandlerToken) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	sendOK(w, &struct {
-		Token   []byte `json:"token"`
-		Expires int64  `json:"expires"`
-	}{
-		Expires: TOKEN_EXP_TIME,
-		Token:   NewToken(h.Conf.Secret),
-	})
+	site := context.Get(r, "site").(*SiteConf)
+	resp, err := NewTokenResponse(h.Confs.Get().Secret, site)
+	if err != nil {
+		h.Confs.Log().ERROR("Can not issue token: secret: %v", err)
+		sendJSON(w, http.StatusServiceUnavailable, &PostResponse{
+			Status:  statusErr,
+			Message: "Can not issue token",
+		})
+		return
+	}
+	sendOK(w, resp)
 }
 
-func NewToken(secret []byte) []byte {
-	exp := time.Now().Unix() + TOKEN_EXP_TIME
+// Токен: время истечения (8 байт), имя сайта, подпись. Если все ключи
+// выведены из оборота, токен не выдаётся: его всё равно не примет Verify.
+func NewToken(keys Keyring, site string, lifetime time.Duration) ([]byte, error) {
+	key := keys.Primary()
+	if key == nil {
+		return nil, ErrNoActiveKey
+	}
+
+	exp := time.Now().Add(lifetime).Unix()
 
-	mac := hmac.New(sha256.New, secret)
 	buf := new(bytes.Buffer)
 	binary.Write(buf, binary.LittleEndian, exp)
-	binary.Write(mac, binary.LittleEndian, exp)
+	buf.WriteString(site)
+
+	mac := hmac.New(sha256.New, key.Secret)
+	mac.Write(buf.Bytes())
 	buf.Write(mac.Sum(nil))
 
-	return buf.Bytes()
+	return buf.Bytes(), nil
 }
 
-func CheckToken(token, secret []byte) bool {
-	if len(token) != 8+sha256.Size {
-		return false
+func CheckToken(token []byte, keys Keyring, site string) error {
+	if len(token) < 8+sha256.Size {
+		return ErrTokenInvalid
+	}
+	signed, sign := token[:len(token)-sha256.Size], token[len(token)-sha256.Size:]
+
+	if !keys.Verify(func(secret []byte) bool {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sign)
+	}) {
+		return ErrTokenInvalid
+	}
+
+	if ts := binary.LittleEndian.Uint64(signed[:8]); uint64(time.Now().Unix()) >= ts {
+		return ErrTokenExpired
+	}
+	if string(signed[8:]) != site {
+		return ErrTokenWrongSite
 	}
-	ts := binary.LittleEndian.Uint64(token[:8])
-	mac := hmac.New(sha256.New, secret)
-	mac.Write(token[:8])
-	return hmac.Equal(mac.Sum(nil), token[8:]) && uint64(time.Now().Unix()) < ts
+	return nil
 }
@@ -2,9 +2,10 @@ package main
 
 import (
 	"net/http"
+	"sync/atomic"
 	"time"
 
-	"github.com/davidmz/halley2/internal/npool"
+	"github.com/davidmz/halley2/internal/broker"
 	"github.com/davidmz/logg"
 	"github.com/facebookgo/inject"
 	"github.com/gorilla/context"
@@ -12,10 +13,13 @@ import (
 )
 
 type HandlerWs struct {
-	Log  *logg.Logger        `inject:""`
-	Upgr *websocket.Upgrader `inject:""`
-	Pool npool.NamedPool     `inject:""`
-	Conf *Conf               `inject:""`
+	Upgr      *websocket.Upgrader `inject:""`
+	Broker    broker.Broker       `inject:""`
+	Publisher *Publisher          `inject:""`
+	Stats     *Stats              `inject:""`
+	Metrics   *Metrics            `inject:""`
+	Sessions  *Sessions           `inject:""`
+	Confs     *ConfStore          `inject:""`
 }
 
 const (
@@ -24,7 +28,7 @@ const (
 )
 
 func (h *HandlerWs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log := h.Log.ChildWithPrefix(r.RemoteAddr)
+	log := h.Confs.Log().ChildWithPrefix(r.RemoteAddr)
 
 	log.TRACE("New ws request")
 	defer log.TRACE("End of ws request")
@@ -44,7 +48,7 @@ func (h *HandlerWs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	KeepAlive(conn, endHandling, log)
 
 	sess := NewSession(conn)
-	if err := inject.Populate(log, site, h.Pool, h.Conf, sess); err != nil {
+	if err := inject.Populate(log, site, h.Broker, h.Publisher, h.Stats, h.Metrics, h.Sessions, h.Confs, sess); err != nil {
 		log.ERROR("Initialization error: %v", err)
 		return
 	}
@@ -52,6 +56,20 @@ func (h *HandlerWs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	sess.Run()
 }
 
+// Проверка Origin при открытии WebSocket по настройкам сайта
+func originChecker(confs *ConfStore, stats *Stats) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		site := context.Get(r, "site").(*SiteConf)
+		origin := r.Header.Get("Origin")
+		if site.OriginAllowed(origin) {
+			return true
+		}
+		confs.Log().INFO("WebSocket from origin %q rejected for site %q", origin, site.Name)
+		atomic.AddUint64(&stats.Site(site.Name).RejectedOrigins, 1)
+		return false
+	}
+}
+
 func KeepAlive(conn *websocket.Conn, close <-chan struct{}, log *logg.Logger) {
 	go func() {
 		ticker := time.NewTicker(PingInterval)
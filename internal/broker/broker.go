@@ -0,0 +1,74 @@
+// Прослойка между обработчиками запросов и каналами.
+package broker
+
+import (
+	"errors"
+
+	"github.com/davidmz/halley2/internal/channel"
+	"github.com/davidmz/halley2/internal/npool"
+)
+
+// Публикация в канал, имя которого является шаблоном
+var ErrInvalidChannel = errors.New("invalid channel name")
+
+type Broker interface {
+	// Публикует сообщение в канале и возвращает присвоенный ему номер
+	Publish(key channel.ChanKey, body []byte) (channel.Ord, error)
+	// Подписывает получателя на канал, after имеет тот же смысл, что и в
+	// channel.Channel.Subscribe. Если имя канала является шаблоном (см.
+	// channel.IsPattern), получатель подписывается на все подходящие каналы,
+	// after и p при этом не учитываются.
+	Subscribe(key channel.ChanKey, rcv channel.Receiver, after channel.Ord, p channel.Presence)
+	// Отписывает получателя от канала
+	Unsubscribe(key channel.ChanKey, rcv channel.Receiver)
+	// Сообщения из буфера канала, см. channel.Channel.History
+	History(key channel.ChanKey, after, before channel.Ord, limit int) []*channel.Message
+	// Участники, подписанные на канал
+	Members(key channel.ChanKey) []string
+}
+
+// Брокер, работающий с каналами этого процесса
+type Local struct {
+	pool     npool.NamedPool
+	patterns *channel.PatternSet
+}
+
+// patterns должен быть тем же, что передан каналам пула в channel.ChanConf
+func NewLocal(pool npool.NamedPool, patterns *channel.PatternSet) *Local {
+	return &Local{pool: pool, patterns: patterns}
+}
+
+func (b *Local) Publish(key channel.ChanKey, body []byte) (channel.Ord, error) {
+	if channel.IsPattern(key.Name) {
+		return 0, ErrInvalidChannel
+	}
+	return b.channel(key).AddMessage(body)
+}
+
+func (b *Local) Subscribe(key channel.ChanKey, rcv channel.Receiver, after channel.Ord, p channel.Presence) {
+	if channel.IsPattern(key.Name) {
+		b.patterns.Subscribe(key.Site, key.Name, rcv)
+		return
+	}
+	b.channel(key).Subscribe(rcv, after, p)
+}
+
+func (b *Local) Unsubscribe(key channel.ChanKey, rcv channel.Receiver) {
+	if channel.IsPattern(key.Name) {
+		b.patterns.Unsubscribe(key.Site, key.Name, rcv)
+		return
+	}
+	b.channel(key).Unsubscribe(rcv)
+}
+
+func (b *Local) History(key channel.ChanKey, after, before channel.Ord, limit int) []*channel.Message {
+	return b.channel(key).History(after, before, limit)
+}
+
+func (b *Local) Members(key channel.ChanKey) []string {
+	return b.channel(key).Members()
+}
+
+func (b *Local) channel(key channel.ChanKey) *channel.Channel {
+	return b.pool.Get(key).(*channel.Channel)
+}
@@ -0,0 +1,264 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/davidmz/halley2/internal/channel"
+	"github.com/davidmz/halley2/internal/npool"
+	"github.com/davidmz/logg"
+)
+
+// Брокер, рассылающий сообщения через общую шину на Redis-совместимом
+// сервере (команды PUBLISH/SUBSCRIBE).
+//
+// Сообщение получает номер на узле, который его опубликовал, и уходит в шину.
+// Все узлы, включая опубликовавший, получают его из шины и доставляют своим
+// подписчикам, поэтому порядок сообщений на всех узлах одинаков.
+type Redis struct {
+	addr    string
+	busName string
+	log     *logg.Logger
+	local   *Local
+
+	ioTimeout    time.Duration
+	pingInterval time.Duration
+
+	lk   sync.Mutex
+	conn net.Conn
+	rw   *bufio.ReadWriter
+}
+
+const dialTimeout = 5 * time.Second
+
+// Значения по умолчанию для новых брокеров
+var (
+	// Сколько ждать записи команды и ответа на неё
+	IOTimeout = 5 * time.Second
+	// Как часто проверять соединение с шиной; если за два интервала от
+	// сервера ничего не пришло, соединение считается разорванным
+	PingInterval = 30 * time.Second
+)
+
+type busMessage struct {
+	Site    string          `json:"site"`
+	Channel string          `json:"channel"`
+	Ord     channel.Ord     `json:"ord"`
+	Time    time.Time       `json:"time"`
+	Body    json.RawMessage `json:"body"`
+}
+
+// Создаёт брокер и подписывается на шину busName
+func NewRedis(addr, busName string, pool npool.NamedPool, patterns *channel.PatternSet, log *logg.Logger) (*Redis, error) {
+	b := &Redis{
+		addr:    addr,
+		busName: busName,
+		log:     log,
+		local:   NewLocal(pool, patterns),
+
+		ioTimeout:    IOTimeout,
+		pingInterval: PingInterval,
+	}
+
+	conn, err := b.subscribe()
+	if err != nil {
+		return nil, err
+	}
+	go b.listen(conn)
+
+	return b, nil
+}
+
+func (b *Redis) Publish(key channel.ChanKey, body []byte) (channel.Ord, error) {
+	if channel.IsPattern(key.Name) {
+		return 0, ErrInvalidChannel
+	}
+
+	ord := channel.NextOrd()
+	msg, err := json.Marshal(&busMessage{
+		Site:    key.Site,
+		Channel: key.Name,
+		Ord:     ord,
+		Time:    time.Now(),
+		Body:    body,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	// одна повторная попытка на случай, если соединение было разорвано
+	for try := 0; ; try++ {
+		err = b.publish(msg)
+		if err == nil {
+			return ord, nil
+		}
+		if _, ok := err.(RespError); ok || try > 0 {
+			return 0, err
+		}
+	}
+}
+
+func (b *Redis) Subscribe(key channel.ChanKey, rcv channel.Receiver, after channel.Ord, p channel.Presence) {
+	b.local.Subscribe(key, rcv, after, p)
+}
+
+func (b *Redis) Unsubscribe(key channel.ChanKey, rcv channel.Receiver) {
+	b.local.Unsubscribe(key, rcv)
+}
+
+func (b *Redis) History(key channel.ChanKey, after, before channel.Ord, limit int) []*channel.Message {
+	return b.local.History(key, after, before, limit)
+}
+
+// Присутствие учитывается только для подписчиков этого узла
+func (b *Redis) Members(key channel.ChanKey) []string {
+	return b.local.Members(key)
+}
+
+//////////////////////////////
+
+// Отправляет PUBLISH, при необходимости устанавливая соединение.
+// Вызывается под b.lk.
+func (b *Redis) publish(msg []byte) error {
+	if b.conn == nil {
+		conn, err := net.DialTimeout("tcp", b.addr, dialTimeout)
+		if err != nil {
+			return err
+		}
+		b.conn = conn
+		b.rw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	}
+
+	// без срока завис бы каждый publish: он ждёт под b.lk
+	b.conn.SetDeadline(time.Now().Add(b.ioTimeout))
+
+	err := writeCommand(b.rw.Writer, []byte("PUBLISH"), []byte(b.busName), msg)
+	if err == nil {
+		var reply interface{}
+		if reply, err = readReply(b.rw.Reader); err == nil {
+			if e, ok := reply.(RespError); ok {
+				return e
+			}
+			return nil
+		}
+	}
+
+	b.conn.Close()
+	b.conn = nil
+	return err
+}
+
+func (b *Redis) subscribe() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", b.addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(b.ioTimeout))
+	w := bufio.NewWriter(conn)
+	if err := writeCommand(w, []byte("SUBSCRIBE"), []byte(b.busName)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Читает сообщения шины, при разрыве соединения переподключается
+func (b *Redis) listen(conn net.Conn) {
+	delay := 100 * time.Millisecond
+	for {
+		err := b.read(conn)
+		b.log.WARN("Bus connection lost: %v", err)
+
+		for {
+			time.Sleep(delay)
+			if conn, err = b.subscribe(); err == nil {
+				delay = 100 * time.Millisecond
+				break
+			}
+			b.log.DEBUG("Can not reconnect to bus: %v", err)
+			if delay < 10*time.Second {
+				delay *= 2
+			}
+		}
+	}
+}
+
+// Читает сообщения из conn, пока соединение живо, и закрывает его.
+// Параллельно шлёт PING, чтобы заметить полуоткрытое соединение.
+func (b *Redis) read(conn net.Conn) error {
+	done := make(chan struct{})
+	defer close(done)
+	defer conn.Close()
+	go b.ping(conn, done)
+
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * b.pingInterval))
+		reply, err := readReply(r)
+		if err != nil {
+			return err
+		}
+		if e, ok := reply.(RespError); ok {
+			return e
+		}
+
+		// ["message", bus, payload], ["subscribe", bus, count] или ["pong", ""]
+		items, ok := reply.([]interface{})
+		if !ok || len(items) == 0 {
+			return fmt.Errorf("unexpected reply %v", reply)
+		}
+		if kind, _ := items[0].([]byte); string(kind) != "message" {
+			continue
+		}
+		if len(items) != 3 {
+			return fmt.Errorf("unexpected message %v", reply)
+		}
+		payload, _ := items[2].([]byte)
+
+		msg := new(busMessage)
+		if err := json.Unmarshal(payload, msg); err != nil {
+			b.log.DEBUG("Invalid bus message: %v", err)
+			continue
+		}
+
+		ch := b.local.channel(channel.ChanKey{
+			Site: msg.Site,
+			Name: msg.Channel,
+		})
+		if err := ch.AddRemoteMessage(&channel.Message{
+			Ord:  msg.Ord,
+			Time: msg.Time,
+			Body: msg.Body,
+		}); err != nil {
+			b.log.ERROR("Can not write message to log: %v", err)
+		}
+	}
+}
+
+// Шлёт PING в соединение подписки, пока не закроется done
+func (b *Redis) ping(conn net.Conn, done chan struct{}) {
+	ticker := time.NewTicker(b.pingInterval)
+	defer ticker.Stop()
+
+	w := bufio.NewWriter(conn)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(b.ioTimeout))
+			if err := writeCommand(w, []byte("PING")); err != nil {
+				// read заметит разрыв по сроку чтения
+				return
+			}
+		}
+	}
+}
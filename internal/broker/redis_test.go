@@ -0,0 +1,212 @@
+package broker_test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davidmz/halley2/internal/broker"
+	"github.com/davidmz/halley2/internal/channel"
+	"github.com/davidmz/halley2/internal/npool"
+	"github.com/davidmz/logg"
+	"github.com/stretchr/testify/require"
+)
+
+// Минимальная замена Redis: понимает только SUBSCRIBE и PUBLISH
+type fakeRedis struct {
+	lk   sync.Mutex
+	ln   net.Listener
+	subs map[string][]net.Conn
+}
+
+func startFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &fakeRedis{ln: ln, subs: make(map[string][]net.Conn)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		switch strings.ToUpper(args[0]) {
+		case "SUBSCRIBE":
+			s.lk.Lock()
+			s.subs[args[1]] = append(s.subs[args[1]], conn)
+			s.lk.Unlock()
+			fmt.Fprintf(conn, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(args[1]), args[1])
+		case "PUBLISH":
+			s.lk.Lock()
+			for _, c := range s.subs[args[1]] {
+				writeArray(c, "message", args[1], args[2])
+			}
+			n := len(s.subs[args[1]])
+			s.lk.Unlock()
+			fmt.Fprintf(conn, ":%d\r\n", n)
+		case "PING":
+			writeArray(conn, "pong", "")
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command\r\n")
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		if args[i], err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(args[i], "\r\n")
+	}
+	return args, nil
+}
+
+func writeArray(conn net.Conn, items ...string) {
+	b := fmt.Sprintf("*%d\r\n", len(items))
+	for _, it := range items {
+		b += fmt.Sprintf("$%d\r\n%s\r\n", len(it), it)
+	}
+	conn.Write([]byte(b))
+}
+
+type rcv chan *channel.Message
+
+func (r rcv) ReceiveMessage(m *channel.Message) { r <- m }
+
+func newPool(patterns *channel.PatternSet) npool.NamedPool {
+	return npool.New((*channel.Channel)(nil), &channel.ChanConf{RingSize: 10, TTL: time.Minute, Patterns: patterns})
+}
+
+func TestRedisBroker(t *testing.T) {
+	srv := startFakeRedis(t)
+	lvl, _ := logg.LevelByName("OFF")
+	log := logg.New(lvl, logg.DefaultWriter)
+
+	p1, p2 := channel.NewPatternSet(), channel.NewPatternSet()
+	b1, err := broker.NewRedis(srv.ln.Addr().String(), "bus", newPool(p1), p1, log)
+	require.NoError(t, err)
+	b2, err := broker.NewRedis(srv.ln.Addr().String(), "bus", newPool(p2), p2, log)
+	require.NoError(t, err)
+
+	key := channel.ChanKey{Site: "site", Name: "foo.bar"}
+	r1, r2 := make(rcv, 1), make(rcv, 1)
+	b1.Subscribe(key, r1, 0, channel.Presence{})
+	// подписка по шаблону
+	b2.Subscribe(channel.ChanKey{Site: "site", Name: "foo.*"}, r2, 0, channel.Presence{})
+
+	// ждём, пока оба брокера подпишутся на шину
+	require.Eventually(t, func() bool {
+		srv.lk.Lock()
+		defer srv.lk.Unlock()
+		return len(srv.subs["bus"]) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = b1.Publish(channel.ChanKey{Site: "site", Name: "foo.*"}, []byte(`1`))
+	require.Equal(t, broker.ErrInvalidChannel, err)
+	ord, err := b1.Publish(key, []byte(`{"a":1}`))
+	require.NoError(t, err)
+
+	var got []*channel.Message
+	for _, r := range []rcv{r1, r2} {
+		select {
+		case m := <-r:
+			got = append(got, m)
+		case <-time.After(time.Second):
+			t.Fatal("message not delivered")
+		}
+	}
+
+	require.Equal(t, "foo.bar", got[0].ChanName)
+	require.Equal(t, "foo.bar", got[1].ChanName)
+	require.JSONEq(t, `{"a":1}`, string(got[0].Body))
+	// оба узла получили сообщение с тем номером, который вернул Publish
+	require.Equal(t, ord, got[0].Ord)
+	require.Equal(t, ord, got[1].Ord)
+}
+
+// Сервер, который принимает соединения, но ничего не отвечает
+func startSilentServer(t *testing.T) (addr string, accepted func() int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var (
+		lk    sync.Mutex
+		n     int
+		conns []net.Conn
+	)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			lk.Lock()
+			n++
+			conns = append(conns, conn)
+			lk.Unlock()
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		lk.Lock()
+		for _, c := range conns {
+			c.Close()
+		}
+		lk.Unlock()
+	})
+	return ln.Addr().String(), func() int {
+		lk.Lock()
+		defer lk.Unlock()
+		return n
+	}
+}
+
+func TestRedisTimeouts(t *testing.T) {
+	ioTimeout, pingInterval := broker.IOTimeout, broker.PingInterval
+	broker.IOTimeout, broker.PingInterval = 100*time.Millisecond, 50*time.Millisecond
+	defer func() { broker.IOTimeout, broker.PingInterval = ioTimeout, pingInterval }()
+
+	addr, accepted := startSilentServer(t)
+	lvl, _ := logg.LevelByName("OFF")
+	p := channel.NewPatternSet()
+	b, err := broker.NewRedis(addr, "bus", newPool(p), p, logg.New(lvl, logg.DefaultWriter))
+	require.NoError(t, err)
+
+	// publish не зависает, если сервер не отвечает
+	start := time.Now()
+	_, err = b.Publish(channel.ChanKey{Site: "site", Name: "foo"}, []byte(`1`))
+	require.Error(t, err)
+	require.Less(t, time.Since(start), 2*time.Second)
+
+	// соединение подписки без ответов на PING переоткрывается
+	// (одно соединение заняла публикация)
+	require.Eventually(t, func() bool { return accepted() >= 3 }, 2*time.Second, 10*time.Millisecond)
+}
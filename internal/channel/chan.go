@@ -2,9 +2,11 @@ package channel
 
 import (
 	"encoding/json"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/davidmz/halley2/internal/msglog"
 	"github.com/davidmz/halley2/internal/npool"
 	"github.com/davidmz/halley2/internal/ring"
 )
@@ -19,56 +21,167 @@ type Message struct {
 	Ord      Ord             `json:"ord"`
 	Time     time.Time       `json:"-"`
 	Body     json.RawMessage `json:"body"`
+	// Сообщение передано из буфера при подписке, а не при публикации
+	Replayed bool `json:"-"`
+}
+
+// Копия сообщения, помеченная как переданная из буфера
+func (m *Message) replayed() *Message {
+	r := *m
+	r.Replayed = true
+	return &r
 }
 
 func NewMessage(b []byte) *Message {
 	return &Message{Body: b, Ord: NextOrd(), Time: time.Now()}
 }
 
+// Получатель сообщений. Сообщения каждого канала передаются ему по одному,
+// в порядке номеров, под блокировкой канала, поэтому ReceiveMessage не
+// должен блокироваться и обращаться к каналу (например, может класть
+// сообщение в очередь).
 type Receiver interface {
 	ReceiveMessage(*Message)
 }
 
+// Событие присутствия: участник появился в канале или ушёл из него
+type PresenceEvent struct {
+	ChanName string `json:"presence"`
+	Event    string `json:"event"` // "join" или "leave"
+	Member   string `json:"member"`
+}
+
+const (
+	PresenceJoin  = "join"
+	PresenceLeave = "leave"
+)
+
+// Получатель событий присутствия. Как и ReceiveMessage, ReceivePresence
+// не должен блокироваться.
+type PresenceReceiver interface {
+	ReceivePresence(*PresenceEvent)
+}
+
+// Параметры присутствия подписчика
+type Presence struct {
+	// Идентификатор участника, "" — анонимный подписчик
+	Member string
+	// Получать события присутствия (получатель должен реализовывать
+	// PresenceReceiver)
+	Notify bool
+}
+
+type subscriber struct {
+	rcv      Receiver
+	presence Presence
+}
+
+// Получатель копий новых сообщений канала (например, другие узлы кластера)
+type Replicator interface {
+	Replicate(key ChanKey, m *Message)
+}
+
+// Получатель сведений о доставке сообщений (для статистики)
+type DeliveryCounter interface {
+	// Сообщение канала key доставлено receivers получателям
+	CountDelivery(key ChanKey, receivers int)
+}
+
+// Состояние канала для статистики
+type ChanInfo struct {
+	Key         ChanKey
+	Subscribers int
+	RingLength  int
+	RingSize    int
+	// Сообщений и доставок с момента активации канала
+	Messages  uint64
+	Delivered uint64
+}
+
 type Channel struct {
 	lk             sync.Mutex
 	key            ChanKey
 	lifeTime       time.Duration
 	messageRing    *ring.Ring
 	sleepFunc      npool.Sleeper
-	subscribers    []Receiver
+	subscribers    []*subscriber
+	members        map[string]int // участник → число его подписок
 	cleanerStarted bool
+	log            *msglog.Log
+	replicator     Replicator
+	patterns       *PatternSet
+	conf           *ChanConf
+	nMessages      uint64
+	nDelivered     uint64
 }
 
-type ChanConf struct {
+// Параметры хранения сообщений канала. RingSize = 0 — история не хранится,
+// сообщения только рассылаются подписчикам.
+type Retention struct {
 	RingSize int
 	TTL      time.Duration
 }
 
+type ChanConf struct {
+	RingSize   int
+	TTL        time.Duration
+	Retention  func(ChanKey) Retention // может быть nil, тогда RingSize и TTL общие для всех
+	Log        *msglog.Log             // может быть nil
+	Replicator Replicator              // может быть nil
+	Patterns   *PatternSet             // может быть nil
+	Counter    DeliveryCounter         // может быть nil
+}
+
+func (c *ChanConf) retentionFor(key ChanKey) Retention {
+	if c.Retention != nil {
+		return c.Retention(key)
+	}
+	return Retention{RingSize: c.RingSize, TTL: c.TTL}
+}
+
 func (c *Channel) New(key interface{}, sleepFunc npool.Sleeper, conf interface{}) {
 	// conf has type *ChanConf
 	// key has type ChanKey
 	cnf := conf.(*ChanConf)
+	c.conf = cnf
 	c.key = key.(ChanKey)
-	c.messageRing = ring.New(cnf.RingSize)
-	c.lifeTime = cnf.TTL
+	c.applyRetention()
+	c.members = make(map[string]int)
+	c.log = cnf.Log
+	c.replicator = cnf.Replicator
+	c.patterns = cnf.Patterns
 	c.sleepFunc = sleepFunc
 }
 
 func (c *Channel) Wakeup(key interface{}, sleepFunc npool.Sleeper) {
 	c.key = key.(ChanKey)
 	c.sleepFunc = sleepFunc
-	c.messageRing.Clean()
+	c.applyRetention()
 	c.subscribers = nil
+	c.members = make(map[string]int)
+	c.nMessages = 0
+	c.nDelivered = 0
+}
+
+// Настраивает кольцо и время жизни сообщений под текущий ключ
+func (c *Channel) applyRetention() {
+	rt := c.conf.retentionFor(c.key)
+	if c.messageRing == nil || c.messageRing.Size() != rt.RingSize {
+		c.messageRing = ring.New(rt.RingSize)
+	} else {
+		c.messageRing.Clean()
+	}
+	c.lifeTime = rt.TTL
 }
 
 func (c *Channel) doSleepIfNeed() {
-	if len(c.subscribers) == 0 && c.messageRing.IsEmpty() {
+	if c.sleepFunc != nil && len(c.subscribers) == 0 && c.messageRing.IsEmpty() {
 		c.sleepFunc()
 		c.sleepFunc = nil
 	}
 }
 
-func (c *Channel) Subscribe(rcv Receiver, from Ord) {
+func (c *Channel) Subscribe(rcv Receiver, from Ord, p Presence) {
 	c.lk.Lock()
 	defer c.lk.Unlock()
 
@@ -78,20 +191,86 @@ func (c *Channel) Subscribe(rcv Receiver, from Ord) {
 		if from < 0 {
 			// последняя запись
 			m := rng.Last().(*Message)
-			go rcv.ReceiveMessage(m)
+			rcv.ReceiveMessage(m.replayed())
 		} else if from > 0 {
-			// все записи с Ord > from
+			// все записи с Ord > from; они передаются под блокировкой,
+			// поэтому придут раньше новых сообщений канала
 			rng.Each(func(_ int, v interface{}) bool {
 				m := v.(*Message)
 				if m.Ord > from {
-					go rcv.ReceiveMessage(m)
+					rcv.ReceiveMessage(m.replayed())
 				}
 				return true
 			})
 		}
 	}
 
-	c.subscribers = append(c.subscribers, rcv)
+	c.subscribers = append(c.subscribers, &subscriber{rcv: rcv, presence: p})
+
+	if p.Member != "" {
+		c.members[p.Member]++
+		if c.members[p.Member] == 1 {
+			c.notifyPresence(PresenceJoin, p.Member)
+		}
+	}
+}
+
+// Текущее состояние канала
+func (c *Channel) Info() *ChanInfo {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	return &ChanInfo{
+		Key:         c.key,
+		Subscribers: len(c.subscribers),
+		RingLength:  c.messageRing.Length(),
+		RingSize:    c.messageRing.Size(),
+		Messages:    c.nMessages,
+		Delivered:   c.nDelivered,
+	}
+}
+
+// Участники, подписанные на канал (по алфавиту)
+func (c *Channel) Members() []string {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	defer c.doSleepIfNeed()
+
+	members := make([]string, 0, len(c.members))
+	for m := range c.members {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// Сообщения из буфера с номерами строго между after и before (before = 0 —
+// без верхней границы), по возрастанию номеров. Если таких сообщений больше
+// limit, то при after > 0 возвращаются самые ранние из них, иначе — самые
+// поздние.
+func (c *Channel) History(after, before Ord, limit int) []*Message {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	defer c.doSleepIfNeed()
+
+	var msgs []*Message
+	c.messageRing.Each(func(_ int, v interface{}) bool {
+		m := v.(*Message)
+		if m.Ord > after && (before == 0 || m.Ord < before) {
+			msgs = append(msgs, m)
+		}
+		return true
+	})
+
+	if limit > 0 && len(msgs) > limit {
+		if after > 0 {
+			msgs = msgs[:limit]
+		} else {
+			msgs = msgs[len(msgs)-limit:]
+		}
+	}
+
+	return msgs
 }
 
 func (c *Channel) Unsubscribe(rcv Receiver) {
@@ -101,37 +280,173 @@ func (c *Channel) Unsubscribe(rcv Receiver) {
 
 	foundIdx := -1
 	for i, v := range c.subscribers {
-		if v == rcv {
+		if v.rcv == rcv {
 			foundIdx = i
 			break
 		}
 	}
 	if foundIdx >= 0 {
+		member := c.subscribers[foundIdx].presence.Member
 		c.subscribers[foundIdx] = nil
 		c.subscribers = append(c.subscribers[:foundIdx], c.subscribers[foundIdx+1:]...)
+
+		if member != "" {
+			c.members[member]--
+			if c.members[member] == 0 {
+				delete(c.members, member)
+				c.notifyPresence(PresenceLeave, member)
+			}
+		}
 	}
 }
 
-func (c *Channel) AddMessage(b []byte) {
+// Рассылает событие присутствия. Вызывается под c.lk.
+func (c *Channel) notifyPresence(event, member string) {
+	ev := &PresenceEvent{
+		ChanName: c.key.Name,
+		Event:    event,
+		Member:   member,
+	}
+	for _, s := range c.subscribers {
+		if pr, ok := s.rcv.(PresenceReceiver); ok && s.presence.Notify {
+			pr.ReceivePresence(ev)
+		}
+	}
+}
+
+// Добавляет сообщение в канал, рассылает его подписчикам и возвращает его
+// номер. Ошибка означает, что сообщение не удалось записать в журнал,
+// при этом подписчикам оно всё равно доставляется.
+func (c *Channel) AddMessage(b []byte) (Ord, error) {
 	c.lk.Lock()
 	defer c.lk.Unlock()
+	// канал без истории и без подписчиков сразу засыпает
+	defer c.doSleepIfNeed()
 
 	m := &Message{
 		Ord:      NextOrd(),
 		ChanName: c.key.Name,
+		Time:     time.Now(),
 		Body:     b,
 	}
 
+	err := c.deliver(m)
+
+	if c.replicator != nil {
+		c.replicator.Replicate(c.key, m)
+	}
+
+	return m.Ord, err
+}
+
+// Добавляет сообщение, пришедшее с другого узла кластера: номер и время
+// сохраняются, дальше по кластеру сообщение не передаётся. Сообщение,
+// которое уже есть в кольце, повторно не доставляется.
+func (c *Channel) AddRemoteMessage(m *Message) error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	defer c.doSleepIfNeed()
+
+	SeenOrd(m.Ord)
+	if c.inRing(m.Ord) {
+		return nil
+	}
+	m.ChanName = c.key.Name
+
+	return c.deliver(m)
+}
+
+// Есть ли в кольце сообщение с номером o. Вызывается под c.lk.
+func (c *Channel) inRing(o Ord) bool {
+	for i := c.messageRing.Length() - 1; i >= 0; i-- {
+		m := c.messageRing.Item(i).(*Message)
+		if m.Ord <= o {
+			return m.Ord == o
+		}
+	}
+	return false
+}
+
+// Пишет сообщение в журнал и в кольцо и рассылает подписчикам.
+// Вызывается под c.lk.
+func (c *Channel) deliver(m *Message) error {
+	var err error
+	if c.log != nil && c.messageRing.Size() > 0 {
+		err = c.log.Append(c.key.Site, &msglog.Record{
+			Channel: m.ChanName,
+			Ord:     int64(m.Ord),
+			Time:    m.Time,
+			Body:    m.Body,
+		})
+	}
+
+	c.appendToRing(m)
+
+	for _, s := range c.subscribers {
+		s.rcv.ReceiveMessage(m)
+	}
+	n := len(c.subscribers)
+
+	if c.patterns != nil {
+		n += c.patterns.deliver(c.key, m)
+	}
+
+	c.nMessages++
+	c.nDelivered += uint64(n)
+	if c.conf.Counter != nil {
+		c.conf.Counter.CountDelivery(c.key, n)
+	}
+
+	return err
+}
+
+// Восстанавливает сообщение из журнала, не рассылая его и не записывая
+// повторно
+func (c *Channel) Restore(rec *msglog.Record) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	defer c.doSleepIfNeed()
+
+	SeenOrd(Ord(rec.Ord))
+
+	if rec.Time.Before(time.Now().Add(-c.lifeTime)) {
+		return
+	}
+
+	c.appendToRing(&Message{
+		Ord:      Ord(rec.Ord),
+		ChanName: c.key.Name,
+		Time:     rec.Time,
+		Body:     rec.Body,
+	})
+}
+
+// Добавляет сообщение в кольцо по порядку номеров. Сообщения других узлов
+// могут прийти позже сообщений с бо́льшими номерами; если кольцо полно,
+// вытесняется самое старое сообщение.
+func (c *Channel) appendToRing(m *Message) {
+	if c.messageRing.Size() == 0 {
+		return
+	}
+
+	var tail []interface{}
+	for !c.messageRing.IsEmpty() {
+		last := c.messageRing.Last()
+		if last.(*Message).Ord < m.Ord {
+			break
+		}
+		tail = append(tail, last)
+		c.messageRing.RemoveLast()
+	}
 	c.messageRing.Append(m)
+	for i := len(tail) - 1; i >= 0; i-- {
+		c.messageRing.Append(tail[i])
+	}
 
 	if !c.cleanerStarted {
 		c.cleanerStarted = true
 		time.AfterFunc(c.lifeTime, c.cleanOlds)
 	}
-
-	for _, s := range c.subscribers {
-		go s.ReceiveMessage(m)
-	}
 }
 
 func (c *Channel) cleanOlds() {
@@ -0,0 +1,204 @@
+package channel_test
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davidmz/halley2/internal/channel"
+	"github.com/davidmz/halley2/internal/npool"
+	"github.com/stretchr/testify/require"
+)
+
+type ordRecorder struct {
+	lk   sync.Mutex
+	ords []channel.Ord
+}
+
+func (r *ordRecorder) ReceiveMessage(m *channel.Message) {
+	r.lk.Lock()
+	r.ords = append(r.ords, m.Ord)
+	r.lk.Unlock()
+}
+
+func (r *ordRecorder) received() []channel.Ord {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	return append([]channel.Ord(nil), r.ords...)
+}
+
+func TestDeliveryOrder(t *testing.T) {
+	const (
+		publishers  = 8
+		perPub      = 500
+		subscribers = 16
+	)
+
+	pool := npool.New((*channel.Channel)(nil), &channel.ChanConf{
+		RingSize: publishers * perPub,
+		TTL:      time.Minute,
+	})
+	ch := pool.Get(channel.ChanKey{Site: "site", Name: "stress"}).(*channel.Channel)
+
+	// подписчик с самого начала
+	first := new(ordRecorder)
+	ch.Subscribe(first, 0, channel.Presence{})
+
+	var (
+		pubs sync.WaitGroup
+		subs sync.WaitGroup
+		lk   sync.Mutex
+	)
+	type midSub struct {
+		rcv   *ordRecorder
+		after channel.Ord
+	}
+	var mid []*midSub
+
+	// require нельзя вызывать не из горутины теста
+	errs := make(chan error, publishers)
+	for i := 0; i < publishers; i++ {
+		pubs.Add(1)
+		go func(i int) {
+			defer pubs.Done()
+			for j := 0; j < perPub; j++ {
+				if _, err := ch.AddMessage([]byte(strconv.Itoa(i*perPub + j))); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+
+	// подписчики, пришедшие посреди потока и запросившие пропущенное
+	for i := 0; i < subscribers; i++ {
+		subs.Add(1)
+		go func() {
+			defer subs.Done()
+			time.Sleep(time.Millisecond)
+			s := &midSub{rcv: new(ordRecorder)}
+			if last := ch.History(0, 0, 1); len(last) > 0 {
+				s.after = last[0].Ord
+			}
+			ch.Subscribe(s.rcv, s.after, channel.Presence{})
+			lk.Lock()
+			mid = append(mid, s)
+			lk.Unlock()
+		}()
+	}
+
+	pubs.Wait()
+	subs.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	var all []channel.Ord
+	for _, m := range ch.History(0, 0, 0) {
+		all = append(all, m.Ord)
+	}
+	require.Len(t, all, publishers*perPub)
+
+	require.Equal(t, all, first.received())
+
+	for _, s := range mid {
+		var want []channel.Ord
+		for _, o := range all {
+			if o > s.after {
+				want = append(want, o)
+			}
+		}
+		// s.after = 0 — подписка до первого сообщения, без истории
+		require.Equal(t, want, s.rcv.received(), "subscribed after %d", s.after)
+	}
+}
+
+func TestNoHistoryChannelSleeps(t *testing.T) {
+	pool := npool.New((*channel.Channel)(nil), &channel.ChanConf{TTL: time.Minute})
+	key := channel.ChanKey{Site: "site", Name: "typing.1"}
+
+	_, err := pool.Get(key).(*channel.Channel).AddMessage([]byte(`1`))
+	require.NoError(t, err)
+
+	n := 0
+	pool.Each(func(_, _ interface{}) { n++ })
+	require.Equal(t, 0, n)
+}
+
+type msgRecorder []*channel.Message
+
+func (r *msgRecorder) ReceiveMessage(m *channel.Message) { *r = append(*r, m) }
+
+func TestReplayedMessages(t *testing.T) {
+	pool := npool.New((*channel.Channel)(nil), &channel.ChanConf{RingSize: 10, TTL: time.Minute})
+	ch := pool.Get(channel.ChanKey{Site: "site", Name: "replay"}).(*channel.Channel)
+
+	first, err := ch.AddMessage([]byte(`1`))
+	require.NoError(t, err)
+
+	rcv := new(msgRecorder)
+	ch.Subscribe(rcv, first-1, channel.Presence{})
+	_, err = ch.AddMessage([]byte(`2`))
+	require.NoError(t, err)
+
+	require.Len(t, *rcv, 2)
+	require.True(t, (*rcv)[0].Replayed)
+	require.False(t, (*rcv)[1].Replayed)
+	// сообщение в буфере не помечается
+	require.False(t, ch.History(0, 0, 0)[0].Replayed)
+}
+
+func TestRemoteMessagesInOrder(t *testing.T) {
+	pool := npool.New((*channel.Channel)(nil), &channel.ChanConf{RingSize: 3, TTL: time.Minute})
+	ch := pool.Get(channel.ChanKey{Site: "site", Name: "remote"}).(*channel.Channel)
+
+	rcv := new(ordRecorder)
+	ch.Subscribe(rcv, 0, channel.Presence{})
+
+	add := func(ords ...channel.Ord) {
+		for _, o := range ords {
+			require.NoError(t, ch.AddRemoteMessage(&channel.Message{Ord: o, Time: time.Now()}))
+		}
+	}
+	history := func() (ords []channel.Ord) {
+		for _, m := range ch.History(0, 0, 0) {
+			ords = append(ords, m.Ord)
+		}
+		return ords
+	}
+
+	add(10, 30, 20)
+	require.Equal(t, []channel.Ord{10, 20, 30}, history())
+
+	// повтор не доставляется
+	add(20)
+	require.Equal(t, []channel.Ord{10, 30, 20}, rcv.received())
+
+	// старше всего в полном кольце — сразу вытесняется
+	add(5)
+	require.Equal(t, []channel.Ord{10, 20, 30}, history())
+
+	add(25)
+	require.Equal(t, []channel.Ord{20, 25, 30}, history())
+}
+
+func TestNodeOrds(t *testing.T) {
+	channel.SetNode(7)
+	defer channel.SetNode(0)
+
+	prev := channel.NextOrd()
+	for i := 0; i < 1000; i++ {
+		o := channel.NextOrd()
+		require.Equal(t, 7, channel.OrdNode(o))
+		require.Greater(t, o, prev)
+		prev = o
+	}
+
+	// после чужого номера свои номера больше него и остаются своими
+	channel.SeenOrd(prev + 150)
+	o := channel.NextOrd()
+	require.Greater(t, o, prev+150)
+	require.Equal(t, 7, channel.OrdNode(o))
+}
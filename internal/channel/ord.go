@@ -1,19 +1,66 @@
 package channel
 
+import (
+	"sync"
+	"time"
+)
+
+// Номер сообщения. Номера привязаны ко времени (микросекунды от начала эпохи
+// Unix), поэтому после перезапуска сервера продолжают расти, а не начинаются
+// заново с единицы. Значения меньше 2^53 и точно представимы в JavaScript.
+// Две младшие десятичные цифры — номер узла кластера (см. SetNode), так что
+// номера сообщений разных узлов не совпадают.
 type Ord int64
 
-var ordGen = make(chan Ord)
+// Идентификатор запуска сервера (время старта в микросекундах). Меняется при
+// каждом старте процесса, по нему клиенты могут понять, что сервер
+// перезапускался.
+type Epoch int64
+
+// Наибольшее число узлов кластера
+const MaxNodes = 100
+
+var (
+	ordLk   sync.Mutex
+	lastOrd Ord
+	node    Ord
+	epoch   = Epoch(time.Now().UnixNano() / int64(time.Microsecond))
+)
+
+// Задаёт номер узла кластера (от 0 до MaxNodes-1), который попадает
+// в младшие цифры номеров сообщений
+func SetNode(n int) {
+	ordLk.Lock()
+	defer ordLk.Unlock()
+
+	node = Ord(n)
+}
+
+// Номер узла, выдавшего номер сообщения o
+func OrdNode(o Ord) int { return int(o % MaxNodes) }
 
 func NextOrd() Ord {
-	return <-ordGen
+	ordLk.Lock()
+	defer ordLk.Unlock()
+
+	n := Ord(time.Now().UnixNano() / int64(time.Microsecond))
+	n += node - n%MaxNodes
+	if n <= lastOrd {
+		n = lastOrd - lastOrd%MaxNodes + MaxNodes + node
+	}
+	lastOrd = n
+	return n
 }
 
-func init() {
-	go func() {
-		var n Ord
-		for {
-			n++
-			ordGen <- n
-		}
-	}()
+// Гарантирует, что следующие номера будут больше o (используется при
+// восстановлении сообщений, записанных с другими часами)
+func SeenOrd(o Ord) {
+	ordLk.Lock()
+	defer ordLk.Unlock()
+
+	if o > lastOrd {
+		lastOrd = o
+	}
 }
+
+func CurrentEpoch() Epoch { return epoch }
@@ -0,0 +1,126 @@
+package channel
+
+import (
+	"strings"
+	"sync"
+)
+
+// Шаблоны имён каналов.
+//
+// Имя канала делится точками на сегменты. В шаблоне сегмент "*" совпадает
+// с любым одним сегментом, а последний сегмент ">" — с одним или несколькими
+// оставшимися сегментами. Например, "orders.*" совпадает с "orders.42", но не
+// с "orders.42.items", а "orders.>" совпадает с обоими.
+
+const (
+	wildSegment = "*"
+	tailSegment = ">"
+)
+
+// Является ли имя шаблоном
+func IsPattern(name string) bool {
+	segs := strings.Split(name, ".")
+	for i, s := range segs {
+		if s == wildSegment || (s == tailSegment && i == len(segs)-1) {
+			return true
+		}
+	}
+	return false
+}
+
+// Совпадает ли имя канала с шаблоном
+func MatchPattern(pattern, name string) bool {
+	pSegs := strings.Split(pattern, ".")
+	nSegs := strings.Split(name, ".")
+
+	for i, p := range pSegs {
+		if p == tailSegment && i == len(pSegs)-1 {
+			return len(nSegs) > i
+		}
+		if i >= len(nSegs) || (p != wildSegment && p != nSegs[i]) {
+			return false
+		}
+	}
+	return len(pSegs) == len(nSegs)
+}
+
+// Покрывает ли шаблон pattern имя или шаблон name, то есть совпадает ли
+// pattern со всеми каналами, с которыми совпадает name
+func PatternCovers(pattern, name string) bool {
+	pSegs := strings.Split(pattern, ".")
+	nSegs := strings.Split(name, ".")
+
+	for i, p := range pSegs {
+		if p == tailSegment && i == len(pSegs)-1 {
+			return len(nSegs) > i
+		}
+		if i >= len(nSegs) {
+			return false
+		}
+		n := nSegs[i]
+		if n == tailSegment && i == len(nSegs)-1 {
+			return false
+		}
+		if p != wildSegment && (p != n || n == wildSegment) {
+			return false
+		}
+	}
+	return len(pSegs) == len(nSegs)
+}
+
+// Подписки на шаблоны имён каналов всех сайтов
+type PatternSet struct {
+	lk   sync.RWMutex
+	subs map[string][]*patternSub // сайт → подписки
+}
+
+type patternSub struct {
+	pattern string
+	rcv     Receiver
+}
+
+func NewPatternSet() *PatternSet {
+	return &PatternSet{subs: make(map[string][]*patternSub)}
+}
+
+func (p *PatternSet) Subscribe(site, pattern string, rcv Receiver) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	p.subs[site] = append(p.subs[site], &patternSub{pattern: pattern, rcv: rcv})
+}
+
+func (p *PatternSet) Unsubscribe(site, pattern string, rcv Receiver) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	subs := p.subs[site]
+	for i, s := range subs {
+		if s.pattern == pattern && s.rcv == rcv {
+			subs[i] = nil
+			subs = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(subs) == 0 {
+		delete(p.subs, site)
+	} else {
+		p.subs[site] = subs
+	}
+}
+
+// Рассылает сообщение подписчикам, шаблоны которых совпадают с каналом.
+// Возвращает число получателей.
+func (p *PatternSet) deliver(key ChanKey, m *Message) int {
+	p.lk.RLock()
+	defer p.lk.RUnlock()
+
+	n := 0
+	for _, s := range p.subs[key.Site] {
+		if MatchPattern(s.pattern, key.Name) {
+			s.rcv.ReceiveMessage(m)
+			n++
+		}
+	}
+	return n
+}
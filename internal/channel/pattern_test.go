@@ -0,0 +1,58 @@
+package channel_test
+
+import (
+	"testing"
+
+	"github.com/davidmz/halley2/internal/channel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsPattern(t *testing.T) {
+	require.True(t, channel.IsPattern("orders.*"))
+	require.True(t, channel.IsPattern("*.items"))
+	require.True(t, channel.IsPattern("orders.>"))
+	require.False(t, channel.IsPattern("orders"))
+	require.False(t, channel.IsPattern("orders.>.items"))
+	require.False(t, channel.IsPattern("orders*"))
+}
+
+func TestMatchPattern(t *testing.T) {
+	for _, c := range []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"orders.*", "orders.42", true},
+		{"orders.*", "orders.42.items", false},
+		{"orders.*", "orders", false},
+		{"orders.*.items", "orders.42.items", true},
+		{"orders.*.items", "orders.42.users", false},
+		{"orders.>", "orders.42", true},
+		{"orders.>", "orders.42.items", true},
+		{"orders.>", "orders", false},
+		{"*", "orders", true},
+		{"*", "orders.42", false},
+		{">", "orders.42", true},
+	} {
+		require.Equal(t, c.match, channel.MatchPattern(c.pattern, c.name), "%q ~ %q", c.pattern, c.name)
+	}
+}
+
+func TestPatternCovers(t *testing.T) {
+	for _, c := range []struct {
+		pattern, name string
+		covers        bool
+	}{
+		{"orders.*", "orders.42", true},
+		{"orders.*", "orders.*", true},
+		{"orders.*", "orders.>", false},
+		{"orders.>", "orders.*", true},
+		{"orders.>", "orders.*.items", true},
+		{"orders.>", "orders.>", true},
+		{"orders.42", "orders.*", false},
+		{"orders.*.items", "orders.*.items", true},
+		{"*.items", "orders.*", false},
+		{">", "orders.>", true},
+	} {
+		require.Equal(t, c.covers, channel.PatternCovers(c.pattern, c.name), "%q covers %q", c.pattern, c.name)
+	}
+}
@@ -0,0 +1,291 @@
+// Рассылка сообщений по узлам кластера.
+//
+// Каждый узел отправляет новые сообщения своих каналов всем узлам из
+// статического списка, а те доставляют их своим локальным подписчикам.
+// Сообщения передаются с уже присвоенными номером и временем. Номера
+// разных узлов не совпадают (в них входит номер узла, см. channel.SetNode),
+// а в кольцо канала сообщения других узлов вставляются по порядку номеров,
+// так что подписку с after можно возобновить на любом узле.
+//
+// Сообщения для узла копятся в очереди и отправляются пачками; пока узел
+// недоступен, отправка повторяется, и сообщения не теряются.
+//
+// Запросы подписываются вместе со временем отправки и идентификатором
+// узла-отправителя, запросы старше MaxSkew отклоняются. Повторно пришедшие
+// сообщения (тот же узел и номер) отбрасываются.
+package cluster
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidmz/halley2/internal/channel"
+	"github.com/davidmz/halley2/internal/nonce"
+	"github.com/davidmz/logg"
+)
+
+const (
+	// Путь, по которому узлы принимают сообщения друг от друга
+	Path = "/cluster"
+
+	SignatureHeader = "X-Halley-Signature"
+	NodeHeader      = "X-Halley-Node"
+	TimestampHeader = "X-Halley-Timestamp"
+
+	// Наибольшая разница между временем запроса и часами узла
+	MaxSkew = time.Minute
+
+	// Сколько сообщений отправляется одним запросом
+	MaxBatch = 256
+
+	// Наибольшая пауза между попытками отправки на недоступный узел
+	MaxRetryDelay = 10 * time.Second
+)
+
+// Сообщение, передаваемое между узлами
+type Envelope struct {
+	Site    string          `json:"site"`
+	Channel string          `json:"channel"`
+	Ord     channel.Ord     `json:"ord"`
+	Time    time.Time       `json:"time"`
+	Body    json.RawMessage `json:"body"`
+}
+
+func (e *Envelope) Message() *channel.Message {
+	return &channel.Message{
+		ChanName: e.Channel,
+		Ord:      e.Ord,
+		Time:     e.Time,
+		Body:     e.Body,
+	}
+}
+
+type Node struct {
+	secret []byte
+	id     string
+	log    *logg.Logger
+	peers  []*peer
+	seen   *nonce.Cache // принятые сообщения: узел и номер
+}
+
+type peer struct {
+	url    string
+	client *http.Client
+
+	lk    sync.Mutex
+	queue [][]byte      // закодированные Envelope, ждущие отправки
+	wake  chan struct{} // в очереди что-то появилось
+}
+
+// Ставит сообщение в очередь, не блокируясь
+func (p *peer) push(b []byte) {
+	p.lk.Lock()
+	p.queue = append(p.queue, b)
+	p.lk.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Первые (не больше MaxBatch) сообщения очереди; из очереди они удаляются
+// вызовом drop после успешной отправки
+func (p *peer) head() [][]byte {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	if len(p.queue) > MaxBatch {
+		return p.queue[:MaxBatch:MaxBatch]
+	}
+	return p.queue[:len(p.queue):len(p.queue)]
+}
+
+func (p *peer) drop(n int) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	if p.queue = p.queue[n:]; len(p.queue) == 0 {
+		p.queue = nil
+	}
+}
+
+func (p *peer) length() int {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	return len(p.queue)
+}
+
+// Создаёт узел с номером index и запускает отправку сообщений на peers
+// (адреса вида host:port или http://host:port)
+func New(peers []string, secret []byte, index int, log *logg.Logger) *Node {
+	n := &Node{
+		secret: secret,
+		id:     fmt.Sprintf("%d-%d", index, channel.CurrentEpoch()),
+		log:    log,
+		seen:   nonce.New(),
+	}
+	for _, addr := range peers {
+		if !strings.Contains(addr, "://") {
+			addr = "http://" + addr
+		}
+		p := &peer{
+			url:    strings.TrimRight(addr, "/") + Path,
+			client: &http.Client{Timeout: 10 * time.Second},
+			wake:   make(chan struct{}, 1),
+		}
+		n.peers = append(n.peers, p)
+		go n.sendLoop(p)
+	}
+	return n
+}
+
+// Реализует channel.Replicator
+func (n *Node) Replicate(key channel.ChanKey, m *channel.Message) {
+	b, err := json.Marshal(&Envelope{
+		Site:    key.Site,
+		Channel: key.Name,
+		Ord:     m.Ord,
+		Time:    m.Time,
+		Body:    m.Body,
+	})
+	if err != nil {
+		n.log.ERROR("Can not encode message for cluster: %v", err)
+		return
+	}
+
+	for _, p := range n.peers {
+		p.push(b)
+	}
+}
+
+// Проверяет и разбирает запрос от другого узла. Возвращает сообщения, которые
+// ещё не приходили; nil без ошибки, если запрос пришёл от этого же узла.
+func (n *Node) Decode(r *http.Request) ([]*Envelope, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	ts, err := strconv.ParseInt(r.Header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp")
+	}
+
+	sign, err := base64.StdEncoding.DecodeString(r.Header.Get(SignatureHeader))
+	node := r.Header.Get(NodeHeader)
+	if err != nil || !hmac.Equal(sign, n.sign(ts, node, body)) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+
+	if d := time.Since(time.Unix(ts, 0)); d > MaxSkew || d < -MaxSkew {
+		return nil, fmt.Errorf("timestamp out of range")
+	}
+
+	if node == n.id {
+		return nil, nil
+	}
+
+	var envs []*Envelope
+	if body = bytes.TrimSpace(body); len(body) > 0 && body[0] == '[' {
+		err = json.Unmarshal(body, &envs)
+	} else {
+		env := new(Envelope)
+		err = json.Unmarshal(body, env)
+		envs = []*Envelope{env}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// подписанный запрос можно повторить в пределах MaxSkew, а отправитель
+	// повторяет запрос, ответ на который не получил
+	fresh := envs[:0]
+	for _, env := range envs {
+		if n.seen.Add(node+"\x00"+strconv.FormatInt(int64(env.Ord), 10), 2*MaxSkew) {
+			fresh = append(fresh, env)
+		}
+	}
+	return fresh, nil
+}
+
+//////////////////////////////
+
+// Подпись запроса: время отправки (unix), узел-отправитель и тело через "\n"
+func (n *Node) sign(ts int64, node string, body []byte) []byte {
+	mac := hmac.New(sha256.New, n.secret)
+	fmt.Fprintf(mac, "%d\n%s\n", ts, node)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// Отправляет сообщения на узел пачками, сохраняя порядок. При ошибке
+// повторяет отправку с нарастающей паузой (не больше MaxRetryDelay), пока
+// узел не станет доступен.
+func (n *Node) sendLoop(p *peer) {
+	for range p.wake {
+		for {
+			batch := p.head()
+			if len(batch) == 0 {
+				break
+			}
+			body := append(append([]byte{'['}, bytes.Join(batch, []byte{','})...), ']')
+
+			delay, warned := 100*time.Millisecond, false
+			for {
+				err := n.send(p, body)
+				if err == nil {
+					break
+				}
+				n.log.DEBUG("Can not send messages to %v: %v", p.url, err)
+				if delay == MaxRetryDelay && !warned {
+					n.log.WARN("Peer %v is unavailable, %d messages queued", p.url, p.length())
+					warned = true
+				}
+				time.Sleep(delay)
+				if delay *= 2; delay > MaxRetryDelay {
+					delay = MaxRetryDelay
+				}
+			}
+			if warned {
+				n.log.INFO("Peer %v is available again", p.url)
+			}
+			p.drop(len(batch))
+		}
+	}
+}
+
+func (n *Node) send(p *peer, b []byte) error {
+	req, err := http.NewRequest("POST", p.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	ts := time.Now().Unix()
+	req.Header.Set(TimestampHeader, strconv.FormatInt(ts, 10))
+	req.Header.Set(SignatureHeader, base64.StdEncoding.EncodeToString(n.sign(ts, n.id, b)))
+	req.Header.Set(NodeHeader, n.id)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return nil
+}
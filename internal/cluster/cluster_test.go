@@ -0,0 +1,94 @@
+package cluster_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davidmz/halley2/internal/channel"
+	"github.com/davidmz/halley2/internal/cluster"
+	"github.com/davidmz/logg"
+	"github.com/stretchr/testify/require"
+)
+
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+func (r *request) replay() *http.Request {
+	req := httptest.NewRequest("POST", cluster.Path, bytes.NewReader(r.body))
+	req.Header = r.header.Clone()
+	return req
+}
+
+func TestDelivery(t *testing.T) {
+	lvl, _ := logg.LevelByName("OFF")
+	log := logg.New(lvl, logg.DefaultWriter)
+	secret := []byte("secret")
+
+	receiver := cluster.New(nil, secret, 1, log)
+
+	var (
+		lk       sync.Mutex
+		failures = 3 // узел поначалу недоступен
+		ords     []channel.Ord
+		last     *request
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lk.Lock()
+		defer lk.Unlock()
+
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		last = &request{header: r.Header.Clone(), body: body}
+		envs, err := receiver.Decode(last.replay())
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, env := range envs {
+			ords = append(ords, env.Ord)
+		}
+	}))
+	defer srv.Close()
+
+	sender := cluster.New([]string{srv.URL}, secret, 2, log)
+	key := channel.ChanKey{Site: "site", Name: "chan"}
+	var want []channel.Ord
+	for o := channel.Ord(1); o <= 5; o++ {
+		sender.Replicate(key, &channel.Message{Ord: o, Time: time.Now(), Body: []byte(`1`)})
+		want = append(want, o)
+	}
+
+	received := func() []channel.Ord {
+		lk.Lock()
+		defer lk.Unlock()
+		return append([]channel.Ord(nil), ords...)
+	}
+	require.Eventually(t, func() bool { return len(received()) >= len(want) }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, want, received())
+
+	lk.Lock()
+	req := last
+	lk.Unlock()
+
+	// повтор подписанного запроса ничего не доставляет
+	envs, err := receiver.Decode(req.replay())
+	require.NoError(t, err)
+	require.Empty(t, envs)
+
+	// узел-отправитель входит в подпись
+	req.header.Set(cluster.NodeHeader, "other")
+	_, err = receiver.Decode(req.replay())
+	require.Error(t, err)
+}
@@ -0,0 +1,134 @@
+// Проверка JWT (RFC 7519), подписанных по HS256 или EdDSA (Ed25519).
+package jwt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var (
+	ErrMalformed  = errors.New("malformed token")
+	ErrAlgorithm  = errors.New("unsupported algorithm")
+	ErrSignature  = errors.New("invalid signature")
+	ErrExpired    = errors.New("token expired")
+	ErrNotYet     = errors.New("token is not valid yet")
+	ErrNoKeys     = errors.New("no keys to verify token")
+	ErrNoExpiring = errors.New("token has no expiration time")
+)
+
+type Claims struct {
+	Site      string   `json:"site"`
+	Subject   string   `json:"sub,omitempty"`
+	Channels  []string `json:"chans,omitempty"` // шаблоны каналов для подписки
+	Publish   []string `json:"pub,omitempty"`   // шаблоны каналов для публикации
+	Expires   int64    `json:"exp"`
+	NotBefore int64    `json:"nbf,omitempty"`
+}
+
+// Ключи для проверки подписи
+type Keys struct {
+	HMAC    [][]byte            // для HS256
+	Ed25519 []ed25519.PublicKey // для EdDSA
+}
+
+type header struct {
+	Alg string `json:"alg"`
+}
+
+// Похож ли токен на JWT (три части, разделённые точками). Проверяется
+// текст токена в том виде, в каком он пришёл: в base64 точек не бывает.
+func IsJWT(token []byte) bool {
+	return bytes.Count(token, []byte{'.'}) == 2
+}
+
+// Проверяет подпись и срок действия токена и возвращает его claims
+func Parse(token []byte, keys *Keys, now time.Time) (*Claims, error) {
+	parts := bytes.Split(token, []byte{'.'})
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	hdr := new(header)
+	if err := decodePart(parts[0], hdr); err != nil {
+		return nil, ErrMalformed
+	}
+
+	sign, err := base64.RawURLEncoding.DecodeString(string(parts[2]))
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	signed := token[:len(parts[0])+1+len(parts[1])]
+
+	switch hdr.Alg {
+	case "HS256":
+		if len(keys.HMAC) == 0 {
+			return nil, ErrNoKeys
+		}
+		if !verifyHMAC(keys.HMAC, signed, sign) {
+			return nil, ErrSignature
+		}
+	case "EdDSA":
+		if len(keys.Ed25519) == 0 {
+			return nil, ErrNoKeys
+		}
+		if !verifyEd25519(keys.Ed25519, signed, sign) {
+			return nil, ErrSignature
+		}
+	default:
+		return nil, ErrAlgorithm
+	}
+
+	claims := new(Claims)
+	if err := decodePart(parts[1], claims); err != nil {
+		return nil, ErrMalformed
+	}
+
+	if claims.Expires == 0 {
+		return nil, ErrNoExpiring
+	}
+	if now.Unix() >= claims.Expires {
+		return nil, ErrExpired
+	}
+	if claims.NotBefore != 0 && now.Unix() < claims.NotBefore {
+		return nil, ErrNotYet
+	}
+
+	return claims, nil
+}
+
+//////////////////////////////
+
+func decodePart(part []byte, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(string(part))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func verifyHMAC(keys [][]byte, signed, sign []byte) bool {
+	for _, k := range keys {
+		mac := hmac.New(sha256.New, k)
+		mac.Write(signed)
+		if hmac.Equal(mac.Sum(nil), sign) {
+			return true
+		}
+	}
+	return false
+}
+
+func verifyEd25519(keys []ed25519.PublicKey, signed, sign []byte) bool {
+	for _, k := range keys {
+		if ed25519.Verify(k, signed, sign) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package jwt_test
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/davidmz/halley2/internal/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+func encode(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func makeHS256(secret []byte, claims *jwt.Claims) []byte {
+	s := encode(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + encode(claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(s))
+	return []byte(s + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+func makeEdDSA(key ed25519.PrivateKey, claims *jwt.Claims) []byte {
+	s := encode(map[string]string{"alg": "EdDSA", "typ": "JWT"}) + "." + encode(claims)
+	return []byte(s + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, []byte(s))))
+}
+
+func TestHS256(t *testing.T) {
+	now := time.Now()
+	secret := []byte("secret")
+	keys := &jwt.Keys{HMAC: [][]byte{[]byte("old"), secret}}
+
+	tok := makeHS256(secret, &jwt.Claims{Site: "site", Subject: "user", Expires: now.Unix() + 60})
+	require.True(t, jwt.IsJWT(tok))
+
+	claims, err := jwt.Parse(tok, keys, now)
+	require.NoError(t, err)
+	require.Equal(t, "site", claims.Site)
+	require.Equal(t, "user", claims.Subject)
+
+	_, err = jwt.Parse(tok, &jwt.Keys{HMAC: [][]byte{[]byte("other")}}, now)
+	require.Equal(t, jwt.ErrSignature, err)
+
+	_, err = jwt.Parse(tok, keys, now.Add(time.Minute))
+	require.Equal(t, jwt.ErrExpired, err)
+
+	_, err = jwt.Parse(makeHS256(secret, &jwt.Claims{Site: "site"}), keys, now)
+	require.Equal(t, jwt.ErrNoExpiring, err)
+}
+
+func TestEdDSA(t *testing.T) {
+	now := time.Now()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	tok := makeEdDSA(priv, &jwt.Claims{Site: "site", Channels: []string{"orders.>"}, Expires: now.Unix() + 60})
+
+	claims, err := jwt.Parse(tok, &jwt.Keys{Ed25519: []ed25519.PublicKey{pub}}, now)
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders.>"}, claims.Channels)
+
+	// ключ для HS256 не подходит для EdDSA
+	_, err = jwt.Parse(tok, &jwt.Keys{HMAC: [][]byte{pub}}, now)
+	require.Equal(t, jwt.ErrNoKeys, err)
+}
+
+func TestAlgNone(t *testing.T) {
+	s := encode(map[string]string{"alg": "none"}) + "." + encode(&jwt.Claims{Site: "site", Expires: time.Now().Unix() + 60}) + "."
+	_, err := jwt.Parse([]byte(s), &jwt.Keys{HMAC: [][]byte{[]byte("secret")}}, time.Now())
+	require.Equal(t, jwt.ErrAlgorithm, err)
+}
@@ -0,0 +1,288 @@
+// Счётчики, измерители и гистограммы с выводом в текстовом формате
+// Prometheus (https://prometheus.io/docs/instrumenting/exposition_formats/).
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Границы корзин гистограммы по умолчанию (в секундах)
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type Registry struct {
+	lk    sync.Mutex
+	items []metric
+}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+func NewRegistry() *Registry { return new(Registry) }
+
+func (r *Registry) add(m metric) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.items = append(r.items, m)
+}
+
+// Новый счётчик с метками labels
+func (r *Registry) Counter(name, help string, labels ...string) *Vec {
+	v := newVec(name, help, "counter", labels)
+	r.add(v)
+	return v
+}
+
+// Новый измеритель с метками labels
+func (r *Registry) Gauge(name, help string, labels ...string) *Vec {
+	v := newVec(name, help, "gauge", labels)
+	r.add(v)
+	return v
+}
+
+// Новая гистограмма с метками labels. buckets — верхние границы корзин
+// по возрастанию.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		desc:    desc{name: name, help: help, typ: "histogram", labels: labels},
+		buckets: buckets,
+		values:  make(map[string]*histSample),
+	}
+	r.add(h)
+	return h
+}
+
+// Функция, передающая значения метрики при каждом выводе
+type CollectFunc func(emit func(value float64, labelValues ...string))
+
+// Счётчик, значения которого берутся из collect при выводе
+func (r *Registry) CounterFunc(name, help string, labels []string, collect CollectFunc) {
+	r.add(&funcMetric{desc: desc{name: name, help: help, typ: "counter", labels: labels}, collect: collect})
+}
+
+// Измеритель, значения которого берутся из collect при выводе
+func (r *Registry) GaugeFunc(name, help string, labels []string, collect CollectFunc) {
+	r.add(&funcMetric{desc: desc{name: name, help: help, typ: "gauge", labels: labels}, collect: collect})
+}
+
+// Выводит все метрики
+func (r *Registry) Write(w io.Writer) error {
+	r.lk.Lock()
+	items := append([]metric{}, r.items...)
+	r.lk.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range items {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+//////////////////////////////
+
+type desc struct {
+	name, help, typ string
+	labels          []string
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	w.WriteString("# HELP " + d.name + " " + escapeHelp(d.help) + "\n")
+	w.WriteString("# TYPE " + d.name + " " + d.typ + "\n")
+}
+
+// Пишет строку значения: name{labels,extra} value
+func (d *desc) writeSample(w *bufio.Writer, name string, labelValues []string, extraName, extraValue string, value float64) {
+	w.WriteString(name)
+	if len(d.labels) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, l := range d.labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(l + `="` + escapeLabel(labelValues[i]) + `"`)
+		}
+		if extraName != "" {
+			if len(d.labels) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extraName + `="` + extraValue + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+// Набор значений, различающихся метками
+type Vec struct {
+	desc
+	lk     sync.Mutex
+	values map[string]*sample
+}
+
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+func newVec(name, help, typ string, labels []string) *Vec {
+	return &Vec{
+		desc:   desc{name: name, help: help, typ: typ, labels: labels},
+		values: make(map[string]*sample),
+	}
+}
+
+// Значение с данными метками (создаётся при первом обращении).
+// Вызывается под v.lk.
+func (v *Vec) get(labelValues []string) *sample {
+	if len(labelValues) != len(v.labels) {
+		panic("metrics: wrong number of label values for " + v.name)
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.values[key]
+	if !ok {
+		s = &sample{labelValues: append([]string{}, labelValues...)}
+		v.values[key] = s
+	}
+	return s
+}
+
+func (v *Vec) Add(n float64, labelValues ...string) {
+	v.lk.Lock()
+	defer v.lk.Unlock()
+	v.get(labelValues).value += n
+}
+
+func (v *Vec) Inc(labelValues ...string) { v.Add(1, labelValues...) }
+
+func (v *Vec) Set(n float64, labelValues ...string) {
+	v.lk.Lock()
+	defer v.lk.Unlock()
+	v.get(labelValues).value = n
+}
+
+func (v *Vec) write(w *bufio.Writer) {
+	v.lk.Lock()
+	defer v.lk.Unlock()
+
+	v.writeHeader(w)
+	for _, key := range sortedKeys(v.values) {
+		s := v.values[key]
+		v.writeSample(w, v.name, s.labelValues, "", "", s.value)
+	}
+}
+
+type HistogramVec struct {
+	desc
+	buckets []float64
+	lk      sync.Mutex
+	values  map[string]*histSample
+}
+
+type histSample struct {
+	labelValues []string
+	counts      []uint64 // по корзинам, не накопительно
+	count       uint64
+	sum         float64
+}
+
+func (h *HistogramVec) Observe(x float64, labelValues ...string) {
+	if len(labelValues) != len(h.labels) {
+		panic("metrics: wrong number of label values for " + h.name)
+	}
+
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	s, ok := h.values[key]
+	if !ok {
+		s = &histSample{
+			labelValues: append([]string{}, labelValues...),
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = s
+	}
+
+	if i := sort.SearchFloat64s(h.buckets, x); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += x
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	h.writeHeader(w)
+	for _, key := range sortedKeys(h.values) {
+		s := h.values[key]
+		var acc uint64
+		for i, b := range h.buckets {
+			acc += s.counts[i]
+			h.writeSample(w, h.name+"_bucket", s.labelValues, "le", formatFloat(b), float64(acc))
+		}
+		h.writeSample(w, h.name+"_bucket", s.labelValues, "le", "+Inf", float64(s.count))
+		h.writeSample(w, h.name+"_sum", s.labelValues, "", "", s.sum)
+		h.writeSample(w, h.name+"_count", s.labelValues, "", "", float64(s.count))
+	}
+}
+
+type funcMetric struct {
+	desc
+	collect CollectFunc
+}
+
+func (f *funcMetric) write(w *bufio.Writer) {
+	f.writeHeader(w)
+	f.collect(func(value float64, labelValues ...string) {
+		if len(labelValues) != len(f.labels) {
+			panic("metrics: wrong number of label values for " + f.name)
+		}
+		f.writeSample(w, f.name, labelValues, "", "", value)
+	})
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]*sample:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*histSample:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(x float64) string {
+	switch {
+	case math.IsInf(x, 1):
+		return "+Inf"
+	case math.IsInf(x, -1):
+		return "-Inf"
+	case math.IsNaN(x):
+		return "NaN"
+	}
+	return strconv.FormatFloat(x, 'g', -1, 64)
+}
+
+var (
+	helpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpReplacer.Replace(s) }
+func escapeLabel(s string) string { return labelReplacer.Replace(s) }
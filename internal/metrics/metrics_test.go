@@ -0,0 +1,45 @@
+package metrics_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/davidmz/halley2/internal/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	r := metrics.NewRegistry()
+
+	c := r.Counter("test_total", "Test counter", "site")
+	c.Inc("b")
+	c.Add(2, "a")
+	c.Inc("b")
+
+	r.GaugeFunc("test_gauge", "Test gauge", []string{"site", "kind"}, func(emit func(float64, ...string)) {
+		emit(1.5, `x"y`, "z")
+	})
+
+	h := r.Histogram("test_seconds", "Test\nhistogram", []float64{0.1, 1}, "site")
+	h.Observe(0.05, "a")
+	h.Observe(0.5, "a")
+	h.Observe(5, "a")
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, r.Write(buf))
+	require.Equal(t, `# HELP test_total Test counter
+# TYPE test_total counter
+test_total{site="a"} 2
+test_total{site="b"} 2
+# HELP test_gauge Test gauge
+# TYPE test_gauge gauge
+test_gauge{site="x\"y",kind="z"} 1.5
+# HELP test_seconds Test\nhistogram
+# TYPE test_seconds histogram
+test_seconds_bucket{site="a",le="0.1"} 1
+test_seconds_bucket{site="a",le="1"} 2
+test_seconds_bucket{site="a",le="+Inf"} 3
+test_seconds_sum{site="a"} 5.55
+test_seconds_count{site="a"} 3
+`, buf.String())
+}
@@ -0,0 +1,277 @@
+// Журнал сообщений на диске.
+//
+// Для каждого сайта в каталоге данных заводится свой подкаталог, в котором
+// лежат сегменты — файлы с записями в формате JSON, по одной на строку.
+// Запись идёт только в конец последнего сегмента. Сегменты, в которых все
+// записи старше TTL, удаляются целиком.
+package msglog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const segmentExt = ".log"
+
+// Максимальный размер сегмента, после которого начинается новый
+var MaxSegmentSize int64 = 16 << 20
+
+type Record struct {
+	Channel string          `json:"channel"`
+	Ord     int64           `json:"ord"`
+	Time    time.Time       `json:"time"`
+	Body    json.RawMessage `json:"body"`
+}
+
+type Log struct {
+	lk    sync.Mutex
+	dir   string
+	ttl   time.Duration
+	sites map[string]*segment
+}
+
+type segment struct {
+	f       *os.File
+	created time.Time
+	size    int64
+}
+
+// Открывает журнал в каталоге dir, удаляя устаревшие сегменты
+func Open(dir string, ttl time.Duration) (*Log, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	l := &Log{
+		dir:   dir,
+		ttl:   ttl,
+		sites: make(map[string]*segment),
+	}
+	if err := l.Compact(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Дописывает запись в журнал сайта
+func (l *Log) Append(site string, rec *Record) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	seg, err := l.segmentFor(site)
+	if err != nil {
+		return err
+	}
+
+	n, err := seg.f.Write(b)
+	seg.size += int64(n)
+	return err
+}
+
+// Читает все не устаревшие записи всех сайтов в порядке их записи.
+// foo вызывается без блокировки журнала, так что может писать в него.
+func (l *Log) Replay(foo func(site string, rec *Record)) error {
+	type siteFiles struct {
+		site  string
+		files []string
+	}
+
+	// список сегментов берётся под блокировкой, а читаются они без неё
+	var all []siteFiles
+	if err := func() error {
+		l.lk.Lock()
+		defer l.lk.Unlock()
+
+		sites, err := l.siteDirs()
+		if err != nil {
+			return err
+		}
+		for _, site := range sites {
+			files, err := l.segmentFiles(site)
+			if err != nil {
+				return err
+			}
+			all = append(all, siteFiles{site, files})
+		}
+		return nil
+	}(); err != nil {
+		return err
+	}
+
+	minTime := time.Now().Add(-l.ttl)
+	for _, sf := range all {
+		for _, name := range sf.files {
+			if err := readSegment(name, func(rec *Record) {
+				if !rec.Time.Before(minTime) {
+					foo(sf.site, rec)
+				}
+			}); err != nil && !os.IsNotExist(err) {
+				// сегмент мог быть удалён при сжатии после получения списка
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Удаляет сегменты, в которые никто не писал дольше TTL
+func (l *Log) Compact() error {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	sites, err := l.siteDirs()
+	if err != nil {
+		return err
+	}
+
+	minTime := time.Now().Add(-l.ttl)
+	for _, site := range sites {
+		files, err := l.segmentFiles(site)
+		if err != nil {
+			return err
+		}
+		cur := l.sites[site]
+		for _, name := range files {
+			if cur != nil && cur.f.Name() == name {
+				continue
+			}
+			if st, err := os.Stat(name); err != nil {
+				return err
+			} else if st.ModTime().Before(minTime) {
+				if err := os.Remove(name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Закрывает все открытые сегменты
+func (l *Log) Close() error {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	var firstErr error
+	for site, seg := range l.sites {
+		if err := seg.f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(l.sites, site)
+	}
+	return firstErr
+}
+
+//////////////////////////////
+
+// Текущий сегмент сайта; при необходимости начинает новый.
+// Вызывается под l.lk.
+func (l *Log) segmentFor(site string) (*segment, error) {
+	seg := l.sites[site]
+	if seg != nil && seg.size < MaxSegmentSize && time.Since(seg.created) < l.ttl {
+		return seg, nil
+	}
+
+	rotated := seg != nil
+	if rotated {
+		seg.f.Close()
+		delete(l.sites, site)
+	}
+
+	dir := filepath.Join(l.dir, url.PathEscape(site))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	name := filepath.Join(dir, fmt.Sprintf("%016x%s", now.UnixNano(), segmentExt))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	seg = &segment{f: f, created: now}
+	l.sites[site] = seg
+
+	if rotated {
+		go l.Compact()
+	}
+
+	return seg, nil
+}
+
+// Имена сайтов, для которых есть каталоги
+func (l *Log) siteDirs() ([]string, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	var sites []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if site, err := url.PathUnescape(e.Name()); err == nil {
+			sites = append(sites, site)
+		}
+	}
+	return sites, nil
+}
+
+// Пути к сегментам сайта в порядке их создания
+func (l *Log) segmentFiles(site string) ([]string, error) {
+	dir := filepath.Join(l.dir, url.PathEscape(site))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), segmentExt) {
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func readSegment(name string, foo func(*Record)) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rd := bufio.NewReader(f)
+	for {
+		line, err := rd.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			rec := new(Record)
+			// битые строки (например, недописанные при падении) пропускаем
+			if json.Unmarshal(line, rec) == nil {
+				foo(rec)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
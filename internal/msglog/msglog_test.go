@@ -0,0 +1,62 @@
+package msglog_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/davidmz/halley2/internal/msglog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppendAndReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := msglog.Open(dir, time.Minute)
+	require.NoError(t, err)
+
+	now := time.Now()
+	require.NoError(t, l.Append("a", &msglog.Record{Channel: "foo", Ord: 1, Time: now, Body: json.RawMessage(`1`)}))
+	require.NoError(t, l.Append("b/c", &msglog.Record{Channel: "bar", Ord: 2, Time: now, Body: json.RawMessage(`"x"`)}))
+	require.NoError(t, l.Append("a", &msglog.Record{Channel: "foo", Ord: 3, Time: now, Body: json.RawMessage(`3`)}))
+	// устаревшая запись
+	require.NoError(t, l.Append("a", &msglog.Record{Channel: "foo", Ord: 4, Time: now.Add(-time.Hour), Body: json.RawMessage(`4`)}))
+	require.NoError(t, l.Close())
+
+	l, err = msglog.Open(dir, time.Minute)
+	require.NoError(t, err)
+	defer l.Close()
+
+	got := make(map[string][]int64)
+	require.NoError(t, l.Replay(func(site string, rec *msglog.Record) {
+		got[site] = append(got[site], rec.Ord)
+	}))
+	require.Equal(t, map[string][]int64{"a": {1, 3}, "b/c": {2}}, got)
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := msglog.Open(dir, time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, l.Append("a", &msglog.Record{Channel: "foo", Ord: 1, Time: time.Now(), Body: json.RawMessage(`1`)}))
+	require.NoError(t, l.Close())
+
+	files, err := filepath.Glob(filepath.Join(dir, "a", "*.log"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(files[0], old, old))
+
+	// старые сегменты удаляются при открытии
+	l, err = msglog.Open(dir, time.Minute)
+	require.NoError(t, err)
+	defer l.Close()
+
+	files, err = filepath.Glob(filepath.Join(dir, "a", "*.log"))
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
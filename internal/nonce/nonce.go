@@ -0,0 +1,59 @@
+// Память о недавно использованных одноразовых идентификаторах запросов.
+package nonce
+
+import (
+	"sync"
+	"time"
+)
+
+// Как часто удалять устаревшие записи
+const cleanInterval = time.Minute
+
+type Cache struct {
+	lk        sync.Mutex
+	items     map[string]time.Time // ключ → когда его можно забыть
+	lastClean time.Time
+}
+
+func New() *Cache {
+	return &Cache{
+		items:     make(map[string]time.Time),
+		lastClean: time.Now(),
+	}
+}
+
+// Запоминает ключ на время ttl. Возвращает false, если ключ уже был
+// запомнен и ещё не забыт.
+func (c *Cache) Add(key string, ttl time.Duration) bool {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.lastClean) > cleanInterval {
+		c.clean(now)
+	}
+
+	if exp, ok := c.items[key]; ok && now.Before(exp) {
+		return false
+	}
+	c.items[key] = now.Add(ttl)
+	return true
+}
+
+// Забывает ключ (например, если запрос не удалось выполнить и его можно
+// повторить)
+func (c *Cache) Forget(key string) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	delete(c.items, key)
+}
+
+func (c *Cache) clean(now time.Time) {
+	for k, exp := range c.items {
+		if !now.Before(exp) {
+			delete(c.items, k)
+		}
+	}
+	c.lastClean = now
+}
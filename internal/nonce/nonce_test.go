@@ -0,0 +1,30 @@
+package nonce_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/davidmz/halley2/internal/nonce"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdd(t *testing.T) {
+	c := nonce.New()
+
+	require.True(t, c.Add("a", time.Minute))
+	require.False(t, c.Add("a", time.Minute))
+	require.True(t, c.Add("b", time.Minute))
+
+	// истёкший ключ можно использовать снова
+	require.True(t, c.Add("c", time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+	require.True(t, c.Add("c", time.Minute))
+}
+
+func TestForget(t *testing.T) {
+	c := nonce.New()
+
+	require.True(t, c.Add("a", time.Minute))
+	c.Forget("a")
+	require.True(t, c.Add("a", time.Minute))
+}
@@ -3,6 +3,10 @@ package npool
 // Реестр объектов с доступом по строковому ключу
 type NamedPool interface {
 	Get(key interface{}) interface{}
+	// Вызывает foo для каждого активного объекта. Список объектов берётся
+	// на момент вызова, так что foo может обращаться к пулу и объект может
+	// успеть стать неактивным.
+	Each(foo func(key, obj interface{}))
 }
 
 type Sleeper func()
@@ -53,3 +53,17 @@ func TestNamedPool(t *testing.T) {
 	require.Equal(t, "new", o.S)
 	require.Equal(t, "a", o.K)
 }
+
+func TestEach(t *testing.T) {
+	pool := npool.New((*Obj)(nil), "new")
+	getObjFromPool(t, pool, "a")
+	getObjFromPool(t, pool, "b").Sleep()
+	getObjFromPool(t, pool, "c")
+
+	keys := make(map[string]bool)
+	pool.Each(func(key, obj interface{}) {
+		require.Equal(t, key, obj.(*Obj).K)
+		keys[key.(string)] = true
+	})
+	require.Equal(t, map[string]bool{"a": true, "c": true}, keys)
+}
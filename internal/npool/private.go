@@ -34,6 +34,21 @@ func (r *reg) Get(key interface{}) interface{} {
 	return r.createAndGet(key)
 }
 
+func (r *reg) Each(foo func(key, obj interface{})) {
+	r.lk.RLock()
+	keys := make([]interface{}, 0, len(r.items))
+	objs := make([]Wakeupper, 0, len(r.items))
+	for k, v := range r.items {
+		keys = append(keys, k)
+		objs = append(objs, v)
+	}
+	r.lk.RUnlock()
+
+	for i, k := range keys {
+		foo(k, objs[i])
+	}
+}
+
 func (r *reg) createAndGet(key interface{}) interface{} {
 	r.lk.Lock()
 	defer r.lk.Unlock()
@@ -39,6 +39,9 @@ func (r *Ring) Item(n int) interface{} {
 
 // Добавить элемент в хвост
 func (r *Ring) Append(v interface{}) {
+	if r.size == 0 { // буфер нулевого размера ничего не хранит
+		return
+	}
 	if r.length == r.size { // буфер полон
 		r.items[r.head] = v
 		r.head = r.rAdd(r.head, 1)
@@ -51,6 +54,9 @@ func (r *Ring) Append(v interface{}) {
 
 // Добавить элемент в голову
 func (r *Ring) Prepend(v interface{}) {
+	if r.size == 0 {
+		return
+	}
 	r.head = r.rAdd(r.head, -1)
 	r.items[r.head] = v
 	if r.length < r.size {
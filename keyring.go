@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Секретный ключ с идентификатором и, возможно, датой вывода из оборота
+type Key struct {
+	ID      string
+	Secret  []byte
+	Retires time.Time // нулевое значение — бессрочно
+}
+
+func (k *Key) IsActive(now time.Time) bool {
+	return k.Retires.IsZero() || now.Before(k.Retires)
+}
+
+// Набор ключей. Первый действующий ключ — основной, им подписывается всё
+// новое; проверка подписи проходит с любым действующим ключом.
+type Keyring []*Key
+
+// Разбирает список ключей через запятую. Каждый ключ записывается как
+// "base64", "id:base64" или "id:base64:дата", где дата — YYYY-MM-DD или
+// RFC 3339. Идентификаторы не должны повторяться, и хотя бы один ключ
+// должен действовать.
+func ParseKeyring(s string) (Keyring, error) {
+	var keys Keyring
+	ids := make(map[string]bool)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		k := new(Key)
+		parts := strings.SplitN(item, ":", 3)
+		b64 := parts[0]
+		if len(parts) > 1 {
+			k.ID, b64 = parts[0], parts[1]
+		}
+		if len(parts) > 2 {
+			if t, err := time.Parse("2006-01-02", parts[2]); err == nil {
+				k.Retires = t
+			} else if t, err := time.Parse(time.RFC3339, parts[2]); err == nil {
+				k.Retires = t
+			} else {
+				return nil, fmt.Errorf("key %q: invalid retirement date %q", k.ID, parts[2])
+			}
+		}
+
+		if x, err := base64.StdEncoding.DecodeString(b64); err != nil {
+			return nil, fmt.Errorf("key %q: %v", k.ID, err)
+		} else {
+			k.Secret = x
+		}
+
+		if k.ID != "" {
+			if ids[k.ID] {
+				return nil, fmt.Errorf("duplicate key id %q", k.ID)
+			}
+			ids[k.ID] = true
+		}
+
+		keys = append(keys, k)
+	}
+
+	if len(keys) == 0 {
+		// как и раньше, отсутствующий ключ — это пустой ключ
+		keys = append(keys, &Key{Secret: []byte{}})
+	}
+
+	if len(keys.Active()) == 0 {
+		return nil, ErrNoActiveKey
+	}
+
+	return keys, nil
+}
+
+// Идентификаторы ключей, выведенных из оборота (ключ без идентификатора
+// обозначается номером в списке, начиная с 1)
+func (k Keyring) Retired() []string {
+	now := time.Now()
+	var ids []string
+	for i, key := range k {
+		if !key.IsActive(now) {
+			if key.ID != "" {
+				ids = append(ids, key.ID)
+			} else {
+				ids = append(ids, fmt.Sprintf("#%d", i+1))
+			}
+		}
+	}
+	return ids
+}
+
+// Ни один ключ набора не действует (все отошли уже после загрузки
+// конфигурации)
+var ErrNoActiveKey = errors.New("all keys have retired")
+
+// Основной ключ; nil, если все ключи выведены из оборота
+func (k Keyring) Primary() *Key {
+	now := time.Now()
+	for _, key := range k {
+		if key.IsActive(now) {
+			return key
+		}
+	}
+	return nil
+}
+
+// Секреты действующих ключей
+func (k Keyring) Active() [][]byte {
+	now := time.Now()
+	var secrets [][]byte
+	for _, key := range k {
+		if key.IsActive(now) {
+			secrets = append(secrets, key.Secret)
+		}
+	}
+	return secrets
+}
+
+// Проверяет подпись всеми действующими ключами
+func (k Keyring) Verify(check func(secret []byte) bool) bool {
+	for _, secret := range k.Active() {
+		if check(secret) {
+			return true
+		}
+	}
+	return false
+}
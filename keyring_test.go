@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseKeyring(t *testing.T) {
+	keys, err := ParseKeyring("k2:zI/s4R2hKBk36jiBrCCLxWbgw0A=, k1:4n0Vx7Uk3OD0tzQ3I1Hv5A==:2000-01-01")
+	require.NoError(t, err)
+	require.Equal(t, "k2", keys.Primary().ID)
+	require.Len(t, keys.Active(), 1)
+	require.Equal(t, []string{"k1"}, keys.Retired())
+
+	_, err = ParseKeyring("k1:4n0Vx7Uk3OD0tzQ3I1Hv5A==:2000-01-01")
+	require.Equal(t, ErrNoActiveKey, err)
+
+	_, err = ParseKeyring("k1:zI/s4R2hKBk36jiBrCCLxWbgw0A=, k1:4n0Vx7Uk3OD0tzQ3I1Hv5A==")
+	require.Error(t, err, "duplicate id")
+}
+
+func TestNoTokenWithRetiredKeys(t *testing.T) {
+	// ключ отошёл уже после загрузки конфигурации
+	keys := Keyring{{ID: "k1", Secret: []byte("secret"), Retires: time.Now().Add(-time.Second)}}
+	require.Nil(t, keys.Primary())
+
+	_, err := NewToken(keys, "site", time.Minute)
+	require.Equal(t, ErrNoActiveKey, err)
+}
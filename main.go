@@ -1,14 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/davidmz/halley2/internal/broker"
 	"github.com/davidmz/halley2/internal/channel"
+	"github.com/davidmz/halley2/internal/cluster"
+	"github.com/davidmz/halley2/internal/msglog"
+	"github.com/davidmz/halley2/internal/nonce"
 	"github.com/davidmz/halley2/internal/npool"
 	"github.com/davidmz/logg"
 	"github.com/davidmz/memcache/simplemmc"
@@ -17,6 +26,8 @@ import (
 	"github.com/sqs/mux"
 )
 
+const DefaultShutdownTimeout = 10 * time.Second
+
 func main() {
 	conf, err := ReadConf()
 	if err != nil {
@@ -25,32 +36,87 @@ func main() {
 	}
 
 	log := logg.New(conf.LogLevel, logg.DefaultWriter)
+	confs := NewConfStore(conf, log)
+	warnRetiredKeys(conf, log)
+	channel.SetNode(conf.NodeIndex)
 
 	handlerWs := new(HandlerWs)
 	handlerPost := new(HandlerPost)
+	handlerPostBatch := new(HandlerPostBatch)
 	handlerToken := new(HandlerToken)
 	handlerStats := new(HandlerStats)
 	handlerMemc := new(HandlerMemc)
+	handlerSSE := new(HandlerSSE)
+	handlerPoll := new(HandlerPoll)
+	handlerHistory := new(HandlerHistory)
 	siteNameChecker := new(SiteNameChecker)
+	handlerMetrics := NewMetrics()
+	sessions := NewSessions()
+
+	stats := NewStats()
 
 	wsUgrader := &websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
-		CheckOrigin:     func(r *http.Request) bool { return true }, // TODO CORS
+		CheckOrigin:     originChecker(confs, stats),
+	}
+
+	var msgLog *msglog.Log
+	if conf.DataDir != "" {
+		if msgLog, err = msglog.Open(conf.DataDir, conf.MaxMsgLifetime()); err != nil {
+			log.FATAL("Can not open message log: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	chanConf := &channel.ChanConf{
+		Retention: func(key channel.ChanKey) channel.Retention { return confs.Get().Retention(key) },
+		Log:       msgLog,
+		Patterns:  channel.NewPatternSet(),
+		Counter:   stats,
+	}
+
+	var clusterNode *cluster.Node
+	if len(conf.Peers) > 0 {
+		clusterNode = cluster.New(conf.Peers, conf.PeerSecret, conf.NodeIndex, log.ChildWithPrefix("cluster"))
+		chanConf.Replicator = clusterNode
+	}
+
+	chanPool := npool.New((*channel.Channel)(nil), chanConf)
+
+	// Журнал читается до запуска брокера, чтобы сообщения с шины не попали
+	// в кольца раньше старых
+	if msgLog != nil {
+		n := 0
+		if err := msgLog.Replay(func(site string, rec *msglog.Record) {
+			chanPool.Get(channel.ChanKey{
+				Site: site,
+				Name: rec.Channel,
+			}).(*channel.Channel).Restore(rec)
+			n++
+		}); err != nil {
+			log.FATAL("Can not read message log: %v", err)
+			os.Exit(1)
+		}
+		log.INFO("Restored %d messages from %v", n, conf.DataDir)
 	}
 
-	chanPool := npool.New(
-		(*channel.Channel)(nil),
-		&channel.ChanConf{
-			RingSize: conf.ChannelSize,
-			TTL:      conf.MsgLifetime,
-		},
-	)
+	var msgBroker broker.Broker
+	if conf.Broker == "redis" {
+		if msgBroker, err = broker.NewRedis(conf.RedisAddr, conf.RedisBus, chanPool, chanConf.Patterns, log.ChildWithPrefix("redis")); err != nil {
+			log.FATAL("Can not connect to redis: %v", err)
+			os.Exit(1)
+		}
+	} else {
+		msgBroker = broker.NewLocal(chanPool, chanConf.Patterns)
+	}
+	msgBroker = &countingBroker{Broker: msgBroker, stats: stats}
 
 	if err := inject.Populate(
-		log, wsUgrader, chanPool,
-		handlerWs, handlerPost, handlerToken, handlerStats, handlerMemc,
-		conf, siteNameChecker,
+		wsUgrader, chanPool, msgBroker, nonce.New(), new(Publisher), stats, handlerMetrics, sessions,
+		handlerWs, handlerPost, handlerPostBatch, handlerToken, handlerStats, handlerMemc,
+		handlerSSE, handlerPoll, handlerHistory,
+		confs, siteNameChecker,
 	); err != nil {
 		log.FATAL("Initialization error: %v", err)
 		os.Exit(1)
@@ -58,16 +124,32 @@ func main() {
 
 	router := mux.NewRouter()
 	router.Handle("/ws", siteNameChecker.Check(handlerWs))
+	router.Handle("/sse", siteNameChecker.Check(handlerSSE))
+	router.Handle("/poll", siteNameChecker.Check(handlerPoll))
+	router.Handle("/history", siteNameChecker.Check(handlerHistory))
 	router.Handle("/post", siteNameChecker.Check(handlerPost))
+	router.Handle("/post-batch", siteNameChecker.Check(handlerPostBatch))
 	router.Handle("/token", siteNameChecker.Check(handlerToken))
 	router.Handle("/next-ord", siteNameChecker.Check(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		sendOK(w, &struct {
-			NextOrd channel.Ord `json:"next_ord"`
+			NextOrd channel.Ord   `json:"next_ord"`
+			Epoch   channel.Epoch `json:"epoch"`
 		}{
 			NextOrd: channel.NextOrd(),
+			Epoch:   channel.CurrentEpoch(),
 		})
 	})))
 	router.Handle("/stats", handlerStats)
+	router.Handle("/metrics", handlerMetrics)
+
+	if clusterNode != nil {
+		handlerCluster := new(HandlerCluster)
+		if err := inject.Populate(chanPool, confs, clusterNode, handlerCluster); err != nil {
+			log.FATAL("Initialization error: %v", err)
+			os.Exit(1)
+		}
+		router.Handle(cluster.Path, handlerCluster)
+	}
 
 	startErrors := make(chan error)
 
@@ -78,20 +160,112 @@ func main() {
 		}()
 	}
 
+	// Контекст всех HTTP-запросов, отменяется при остановке сервера,
+	// чтобы завершились SSE-потоки и long polling
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+
+	httpServer := &http.Server{
+		Addr:         conf.ListenAddr,
+		Handler:      router,
+		ReadTimeout:  10 * time.Minute,
+		WriteTimeout: 10 * time.Minute,
+		BaseContext:  func(net.Listener) context.Context { return baseCtx },
+	}
+	httpServer.RegisterOnShutdown(cancelRequests)
+
 	go func() {
 		log.INFO("Starting http/ws server at %v", conf.ListenAddr)
-		s := &http.Server{
-			Addr:         conf.ListenAddr,
-			Handler:      router,
-			ReadTimeout:  10 * time.Minute,
-			WriteTimeout: 10 * time.Minute,
+		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+			startErrors <- err
 		}
-		startErrors <- s.ListenAndServe()
 	}()
 
-	if err := <-startErrors; err != nil {
-		log.FATAL("Can not start server: %v", err)
-		os.Exit(1)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+L:
+	for {
+		select {
+		case err := <-startErrors:
+			log.FATAL("Can not start server: %v", err)
+			os.Exit(1)
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				reloadConf(confs, sessions)
+				continue
+			}
+			log = confs.Log()
+			log.INFO("Got %v, shutting down", sig)
+			break L
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), confs.Get().ShutdownTimeout)
+	defer cancel()
+
+	// Новые соединения и сообщения больше не принимаются, начатые запросы
+	// завершаются, WebSocket-клиенты получают закрывающий кадр
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.WARN("HTTP server shutdown: %v", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		// simplemmc не умеет останавливать сервер, так что его слушатель
+		// закрывается при выходе из процесса, а до тех пор новые
+		// сообщения отклоняются
+		if err := handlerMemc.Drain(ctx); err != nil {
+			log.WARN("Memcache requests are not finished: %v", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		sessions.GoAway(nil)
+		if err := sessions.Wait(ctx); err != nil {
+			log.WARN("WebSocket sessions are not closed: %v", err)
+		}
+	}()
+	wg.Wait()
+
+	if msgLog != nil {
+		if err := msgLog.Close(); err != nil {
+			log.ERROR("Can not close message log: %v", err)
+		}
+	}
+	log.INFO("Stopped")
+}
+
+// Перечитывает конфигурацию. Если она с ошибкой, остаётся старая.
+// Сессии удалённых сайтов закрываются, новые настройки хранения сообщений
+// действуют для каналов, активированных после перечитывания.
+func reloadConf(confs *ConfStore, sessions *Sessions) {
+	old := confs.Get()
+	conf, err := LoadConf(old.FileName)
+	if err != nil {
+		confs.Log().ERROR("Can not reload config, keeping the old one: %v", err)
+		return
+	}
+
+	log := logg.New(conf.LogLevel, logg.DefaultWriter)
+	for _, name := range conf.RestartRequired(old) {
+		log.WARN("Config parameter %q changed, restart required to apply it", name)
+	}
+	warnRetiredKeys(conf, log)
+
+	confs.Set(conf, log)
+
+	sessions.GoAway(func(s *Session) bool { return conf.Site(s.Site.Name) == nil })
+
+	log.INFO("Config reloaded from %v", conf.FileName)
+}
+
+func warnRetiredKeys(conf *Conf, log *logg.Logger) {
+	for _, k := range conf.RetiredKeys() {
+		log.WARN("Key %s has retired and can be removed from the config", k)
 	}
 }
 
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/davidmz/halley2/internal/channel"
+	"github.com/davidmz/halley2/internal/metrics"
+	"github.com/davidmz/halley2/internal/npool"
+)
+
+// Метрики для Prometheus, отдаются по /metrics. Счётчики публикаций,
+// доставок и подписок и измерители берутся из Stats при каждом запросе:
+// отчёт (с обходом всех каналов) строится один раз на запрос.
+type Metrics struct {
+	Confs *ConfStore      `inject:""`
+	Stats *Stats          `inject:""`
+	Pool  npool.NamedPool `inject:""`
+
+	scrapeLk sync.Mutex                    // запросы /metrics выполняются по одному
+	report   map[string]*SiteStatsResponse // отчёт текущего запроса
+
+	reg            *metrics.Registry
+	authFailures   *metrics.Vec
+	publishLatency *metrics.HistogramVec
+	writeDuration  *metrics.HistogramVec
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{reg: metrics.NewRegistry()}
+
+	site := []string{"site"}
+
+	m.reg.CounterFunc("halley_published_total", "Messages published through this node.", site,
+		m.siteCounter(func(s *SiteStats) uint64 { return s.Published }))
+	m.reg.CounterFunc("halley_delivered_total", "Messages delivered to subscribers of this node.", site,
+		m.siteCounter(func(s *SiteStats) uint64 { return s.Delivered }))
+	m.reg.CounterFunc("halley_subscribes_total", "Channel subscriptions.", site,
+		m.siteCounter(func(s *SiteStats) uint64 { return s.Subscribes }))
+	m.reg.CounterFunc("halley_unsubscribes_total", "Channel unsubscriptions.", site,
+		m.siteCounter(func(s *SiteStats) uint64 { return s.Unsubscribes }))
+	m.reg.CounterFunc("halley_rejected_origins_total", "WebSocket connections rejected by origin.", site,
+		m.siteCounter(func(s *SiteStats) uint64 { return s.RejectedOrigins }))
+	m.reg.CounterFunc("halley_dropped_messages_total", "Messages dropped from full session queues.", site,
+		m.siteCounter(func(s *SiteStats) uint64 { return s.Dropped }))
+	m.reg.CounterFunc("halley_slow_consumer_disconnects_total", "Sessions closed because of a full queue.", site,
+		m.siteCounter(func(s *SiteStats) uint64 { return s.SlowDisconnects }))
+	m.authFailures = m.reg.Counter("halley_auth_failures_total", "Rejected requests by reason.", "site", "reason")
+
+	m.reg.GaugeFunc("halley_sessions", "Open WebSocket and SSE sessions.", site,
+		m.siteGauge(func(s *SiteStatsResponse) int { return int(s.Sessions) }))
+	m.reg.GaugeFunc("halley_channels", "Active channels.", site,
+		m.siteGauge(func(s *SiteStatsResponse) int { return s.Channels }))
+	m.reg.GaugeFunc("halley_subscribers", "Subscriptions to active channels.", site,
+		m.siteGauge(func(s *SiteStatsResponse) int { return s.Subscribers }))
+	m.reg.GaugeFunc("halley_ring_messages", "Messages stored in channel buffers.", site,
+		m.siteGauge(func(s *SiteStatsResponse) int { return s.RingMessages }))
+	m.reg.GaugeFunc("halley_ring_capacity", "Capacity of channel buffers.", site,
+		m.siteGauge(func(s *SiteStatsResponse) int { return s.RingCapacity }))
+
+	m.publishLatency = m.reg.Histogram("halley_publish_to_write_seconds",
+		"Time from publishing a message to writing it to a client.", metrics.DefaultBuckets, "site")
+	m.writeDuration = m.reg.Histogram("halley_ws_write_seconds",
+		"Duration of WebSocket writes.", metrics.DefaultBuckets, "site")
+
+	return m
+}
+
+// Вызываются из m.reg.Write под m.scrapeLk
+func (m *Metrics) siteCounter(get func(*SiteStats) uint64) metrics.CollectFunc {
+	return func(emit func(float64, ...string)) {
+		for name, s := range m.report {
+			emit(float64(get(s.SiteStats)), name)
+		}
+	}
+}
+
+func (m *Metrics) siteGauge(get func(*SiteStatsResponse) int) metrics.CollectFunc {
+	return func(emit func(float64, ...string)) {
+		for name, s := range m.report {
+			emit(float64(get(s)), name)
+		}
+	}
+}
+
+// Учитывает отказ в доступе
+func (m *Metrics) AuthFailed(site string, err error) {
+	m.authFailures.Inc(site, authFailureReason(err))
+}
+
+// Учитывает запись сообщения клиенту. Сообщения из буфера, переданные при
+// подписке, не учитываются: их задержка — это время, пока клиента не было.
+func (m *Metrics) MessageWritten(site string, msg *channel.Message) {
+	if msg.Replayed {
+		return
+	}
+	m.publishLatency.Observe(time.Since(msg.Time).Seconds(), site)
+}
+
+// Учитывает длительность записи в WebSocket
+func (m *Metrics) WSWritten(site string, d time.Duration) {
+	m.writeDuration.Observe(d.Seconds(), site)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(m.Confs.Get(), r) {
+		m.Confs.Log().DEBUG("Unauthorized metrics request from %v", r.RemoteAddr)
+		sendJSON(w, http.StatusForbidden, &PostResponse{
+			Status:  statusErr,
+			Message: "Forbidden",
+		})
+		return
+	}
+
+	m.scrapeLk.Lock()
+	defer m.scrapeLk.Unlock()
+	m.report = m.Stats.Report(m.Pool, nil)
+	defer func() { m.report = nil }()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := m.reg.Write(w); err != nil {
+		m.Confs.Log().DEBUG("Metrics write error %v", err)
+	}
+}
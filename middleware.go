@@ -3,29 +3,28 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
-	"github.com/davidmz/logg"
 	"github.com/gorilla/context"
 )
 
+const (
+	DefaultCORSMethods = "GET, POST"
+	DefaultCORSHeaders = "Content-Type"
+)
+
 type SiteNameChecker struct {
-	Log  *logg.Logger `inject:""`
-	Conf *Conf        `inject:""`
+	Confs *ConfStore `inject:""`
 }
 
 func (s *SiteNameChecker) Check(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var site *SiteConf
+		log := s.Confs.Log()
 		siteName := r.URL.Query().Get("site")
-		for _, st := range s.Conf.Sites {
-			if st.Name == siteName {
-				site = st
-				break
-			}
-		}
-
+		site := s.Confs.Get().Site(siteName)
 		if site == nil {
-			s.Log.DEBUG("Unknown site %q (%q)", siteName, r.RequestURI)
+			log.DEBUG("Unknown site %q (%q)", siteName, r.RequestURI)
 			sendJSON(w, http.StatusBadRequest, &PostResponse{
 				Status:  statusErr,
 				Message: fmt.Sprintf("Unknown site %q", siteName),
@@ -33,7 +32,34 @@ func (s *SiteNameChecker) Check(h http.Handler) http.Handler {
 			return
 		}
 
-		s.Log.TRACE("Site %q", site.Name)
+		log.TRACE("Site %q", site.Name)
+
+		if origin := r.Header.Get("Origin"); origin != "" && site.CORSOrigins != nil {
+			allowed := site.CORSOrigins.Allows(origin)
+			h := w.Header()
+			if allowed {
+				h.Set("Access-Control-Allow-Origin", origin)
+				h.Add("Vary", "Origin")
+			} else {
+				log.DEBUG("CORS origin %q not allowed for site %q", origin, site.Name)
+			}
+
+			// preflight не доходит до обработчика; без разрешающих
+			// заголовков браузер сам не отправит основной запрос
+			if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+				if allowed {
+					h.Set("Access-Control-Allow-Methods", site.CORSMethods)
+					if site.CORSHeaders != "" {
+						h.Set("Access-Control-Allow-Headers", site.CORSHeaders)
+					}
+					if site.CORSMaxAge > 0 {
+						h.Set("Access-Control-Max-Age", strconv.Itoa(int(site.CORSMaxAge/time.Second)))
+					}
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
 
 		context.Set(r, "site", site)
 
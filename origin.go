@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Список разрешённых источников (Origin) запросов из браузера.
+// Элемент списка — "*" (любой источник), "scheme://host[:port]" или
+// "host[:port]" (любая схема). Хост вида "*.example.com" соответствует
+// любым поддоменам example.com, но не самому example.com.
+type OriginList []*originPattern
+
+type originPattern struct {
+	scheme string // пустая — любая схема
+	host   string // с портом, если он указан
+	any    bool
+}
+
+func ParseOriginList(s string) (OriginList, error) {
+	var list OriginList
+	for _, p := range strings.Split(s, ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "" {
+			continue
+		}
+		if p == "*" {
+			list = append(list, &originPattern{any: true})
+			continue
+		}
+		op := &originPattern{host: p}
+		if i := strings.Index(p, "://"); i >= 0 {
+			op.scheme, op.host = p[:i], p[i+3:]
+		}
+		if op.host == "" || strings.ContainsAny(op.host, "/?#") || strings.Contains(op.host[1:], "*") {
+			return nil, fmt.Errorf("invalid origin %q", p)
+		}
+		list = append(list, op)
+	}
+	return list, nil
+}
+
+// Разрешён ли источник origin (значение заголовка Origin)
+func (l OriginList) Allows(origin string) bool {
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Host == "" {
+		return false
+	}
+	for _, p := range l {
+		if p.matches(u.Scheme, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *originPattern) matches(scheme, host string) bool {
+	if p.any {
+		return true
+	}
+	if p.scheme != "" && p.scheme != scheme {
+		return false
+	}
+	if strings.HasPrefix(p.host, "*.") {
+		return strings.HasSuffix(host, p.host[1:])
+	}
+	return host == p.host
+}
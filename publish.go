@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/davidmz/halley2/internal/broker"
+	"github.com/davidmz/halley2/internal/channel"
+	"github.com/davidmz/halley2/internal/nonce"
+)
+
+// Общая точка публикации для всех способов отправки сообщений
+type Publisher struct {
+	Broker broker.Broker `inject:""`
+	Nonces *nonce.Cache  `inject:""`
+	Stats  *Stats        `inject:""`
+}
+
+// Запрос с таким nonce уже был
+var ErrDuplicate = errors.New("duplicate request")
+
+// Публикует сообщение и возвращает его номер. Если nonce не пуст и уже
+// встречался на этом сайте, сообщение не публикуется и возвращается
+// ErrDuplicate. nonce помнится до until — истечения токена запроса: до тех
+// пор тот же запрос может быть принят повторно.
+func (p *Publisher) Publish(site *SiteConf, chanName string, body []byte, nonce string, until time.Time) (channel.Ord, error) {
+	nonceKey := site.Name + "\x00" + nonce
+	if nonce != "" && !p.Nonces.Add(nonceKey, time.Until(until)) {
+		return 0, ErrDuplicate
+	}
+
+	ord, err := p.publish(site, chanName, body)
+
+	if err != nil && nonce != "" {
+		// запрос не выполнен, его можно повторить
+		p.Nonces.Forget(nonceKey)
+	}
+	return ord, err
+}
+
+// Сообщение пакета
+type BatchItem struct {
+	ChanName    string          `json:"channel"`
+	MessageBody json.RawMessage `json:"message"`
+}
+
+// Результат публикации сообщения пакета: номер или ошибка
+type BatchResult struct {
+	Ord channel.Ord
+	Err error
+}
+
+// Публикует сообщения пакета по порядку и возвращает результаты в том же
+// порядке. Ошибка одного сообщения не мешает публикации остальных. nonce
+// относится ко всему пакету и забывается, только если не опубликовано ни
+// одно сообщение. until — как в Publish.
+func (p *Publisher) PublishBatch(site *SiteConf, items []*BatchItem, nonce string, until time.Time) ([]*BatchResult, error) {
+	nonceKey := site.Name + "\x00" + nonce
+	if nonce != "" && !p.Nonces.Add(nonceKey, time.Until(until)) {
+		return nil, ErrDuplicate
+	}
+
+	results := make([]*BatchResult, len(items))
+	published := 0
+	for i, item := range items {
+		ord, err := p.publish(site, item.ChanName, item.MessageBody)
+		results[i] = &BatchResult{Ord: ord, Err: err}
+		if err == nil {
+			published++
+		}
+	}
+
+	if published == 0 && nonce != "" {
+		p.Nonces.Forget(nonceKey)
+	}
+	return results, nil
+}
+
+func (p *Publisher) publish(site *SiteConf, chanName string, body []byte) (channel.Ord, error) {
+	ord, err := p.Broker.Publish(channel.ChanKey{
+		Site: site.Name,
+		Name: chanName,
+	}, body)
+
+	if err == nil {
+		atomic.AddUint64(&p.Stats.Site(site.Name).Published, 1)
+	}
+	return ord, err
+}
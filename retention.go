@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidmz/halley2/internal/channel"
+	"github.com/vaughan0/go-ini"
+)
+
+// Правило хранения сообщений для каналов сайта, имена которых начинаются с
+// Prefix. Отрицательные значения и пустой History означают, что параметр
+// правилом не задан.
+type RetentionRule struct {
+	Prefix   string
+	RingSize int
+	TTL      time.Duration
+	History  string // "on" или "off"
+}
+
+// Параметры хранения сообщений канала: общие значения, поверх них правила
+// сайта от более коротких префиксов к более длинным
+func (c *Conf) Retention(key channel.ChanKey) channel.Retention {
+	rt := channel.Retention{RingSize: c.ChannelSize, TTL: c.MsgLifetime}
+
+	site := c.Site(key.Site)
+	if site == nil {
+		return rt
+	}
+
+	// history = off не затирает channel_size, чтобы history = on для более
+	// длинного префикса мог вернуть размер буфера
+	historyOff := false
+	for _, r := range site.Retention {
+		if !strings.HasPrefix(key.Name, r.Prefix) {
+			continue
+		}
+		if r.RingSize >= 0 {
+			rt.RingSize = r.RingSize
+		}
+		if r.TTL >= 0 {
+			rt.TTL = r.TTL
+		}
+		if r.History != "" {
+			historyOff = r.History == "off"
+		}
+	}
+
+	if historyOff {
+		rt.RingSize = 0
+	}
+	return rt
+}
+
+// Наибольшее время жизни сообщений среди всех правил
+func (c *Conf) MaxMsgLifetime() time.Duration {
+	ttl := c.MsgLifetime
+	for _, s := range c.Sites {
+		for _, r := range s.Retention {
+			if r.TTL > ttl {
+				ttl = r.TTL
+			}
+		}
+	}
+	return ttl
+}
+
+// Читает правила хранения из секции сайта. Ключи channel_size,
+// message_lifetime и history (on/off) задают правило для всего сайта, они же
+// с суффиксом ".PREFIX" — для каналов с этим префиксом.
+func parseRetention(sect ini.Section) ([]*RetentionRule, error) {
+	rules := make(map[string]*RetentionRule)
+	rule := func(prefix string) *RetentionRule {
+		if rules[prefix] == nil {
+			rules[prefix] = &RetentionRule{Prefix: prefix, RingSize: -1, TTL: -1}
+		}
+		return rules[prefix]
+	}
+
+	for key, val := range sect {
+		name, prefix := key, ""
+		if p := strings.IndexByte(key, '.'); p >= 0 {
+			name, prefix = key[:p], key[p+1:]
+		}
+
+		switch name {
+		case "channel_size":
+			if x, err := strconv.ParseUint(val, 10, 31); err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			} else {
+				rule(prefix).RingSize = int(x)
+			}
+
+		case "message_lifetime":
+			if x, err := time.ParseDuration(val); err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			} else if x < 0 {
+				return nil, fmt.Errorf("%s: negative value", key)
+			} else {
+				rule(prefix).TTL = x
+			}
+
+		case "history":
+			switch val {
+			case "on", "off":
+				rule(prefix).History = val
+			default:
+				return nil, fmt.Errorf("%s: must be on or off", key)
+			}
+		}
+	}
+
+	list := make([]*RetentionRule, 0, len(rules))
+	for _, r := range rules {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return len(list[i].Prefix) < len(list[j].Prefix) })
+
+	return list, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/davidmz/halley2/internal/channel"
+	"github.com/stretchr/testify/require"
+	"github.com/vaughan0/go-ini"
+)
+
+func TestRetention(t *testing.T) {
+	rules, err := parseRetention(ini.Section{
+		"history":                "off",
+		"history.chat.":          "on",
+		"channel_size.chat.big.": "500",
+		"message_lifetime.chat.": "1h",
+		"history.chat.big.quiet": "off",
+	})
+	require.NoError(t, err)
+
+	conf := &Conf{
+		ChannelSize: 100,
+		MsgLifetime: 10 * time.Minute,
+		Sites:       []*SiteConf{{Name: "site", Retention: rules}},
+	}
+	rt := func(name string) channel.Retention {
+		return conf.Retention(channel.ChanKey{Site: "site", Name: name})
+	}
+
+	require.Equal(t, channel.Retention{RingSize: 0, TTL: 10 * time.Minute}, rt("typing.1"))
+	require.Equal(t, channel.Retention{RingSize: 100, TTL: time.Hour}, rt("chat.1"))
+	require.Equal(t, channel.Retention{RingSize: 500, TTL: time.Hour}, rt("chat.big.1"))
+	require.Equal(t, channel.Retention{RingSize: 0, TTL: time.Hour}, rt("chat.big.quiet"))
+	// у других сайтов общие параметры
+	require.Equal(t, channel.Retention{RingSize: 100, TTL: 10 * time.Minute},
+		conf.Retention(channel.ChanKey{Site: "other", Name: "chat.1"}))
+
+	_, err = parseRetention(ini.Section{"history.chat.": "maybe"})
+	require.Error(t, err)
+}
@@ -3,13 +3,20 @@ package main
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io"
+	"math/rand"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/davidmz/halley2/internal/broker"
 	"github.com/davidmz/halley2/internal/channel"
-	"github.com/davidmz/halley2/internal/npool"
+	"github.com/davidmz/halley2/internal/ring"
 	"github.com/davidmz/logg"
+	"github.com/gorilla/websocket"
 )
 
 type CmdRequest struct {
@@ -21,21 +28,113 @@ type CmdRequest struct {
 func (c *CmdRequest) RespOK() *CmdResponse {
 	return &CmdResponse{Status: RespStatusOK, RequestId: c.RequestId}
 }
+func (c *CmdRequest) RespOKWith(body interface{}) *CmdResponse {
+	return &CmdResponse{Status: RespStatusOK, RequestId: c.RequestId, Body: body}
+}
 func (c *CmdRequest) RespErr(msg interface{}) *CmdResponse {
 	return &CmdResponse{Status: RespStatusErr, RequestId: c.RequestId, Body: msg}
 }
 
 type CmdSubscribe struct {
-	Channel string      `json:"channel"`
-	After   channel.Ord `json:"after"`
-	Token   []byte      `json:"token"`
-	Auth    []byte      `json:"auth"`
+	Channel  string      `json:"channel"`
+	After    channel.Ord `json:"after"`
+	Token    Token       `json:"token"`
+	Auth     []byte      `json:"auth"`
+	Member   string      `json:"member"`
+	Presence bool        `json:"presence"`
+}
+
+// Проверяет токен и подпись запроса на подписку. Для JWT подпись не нужна,
+// канал должен быть разрешён в claims, а участником становится subject.
+func (c *CmdSubscribe) Check(conf *Conf, site *SiteConf) error {
+	claims, err := checkSiteToken(conf, site, &c.Token)
+	if err != nil {
+		return err
+	}
+
+	if claims != nil {
+		if !patternsAllow(claims.Channels, c.Channel) {
+			return ErrChannelNotAllowed
+		}
+		if c.Member != "" && c.Member != claims.Subject {
+			return ErrMemberMismatch
+		}
+		c.Member = claims.Subject
+		return nil
+	}
+
+	if !site.Secret.Verify(func(secret []byte) bool {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(c.Channel))
+		mac.Write(c.Token.Bytes)
+		mac.Write([]byte(c.Member))
+		return hmac.Equal(mac.Sum(nil), c.Auth)
+	}) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+type SubscribeResult struct {
+	Epoch channel.Epoch `json:"epoch"`
 }
 
 type CmdUnsubscribe struct {
 	Channel string `json:"channel"`
 }
 
+type CmdPublish struct {
+	Channel string          `json:"channel"`
+	Message json.RawMessage `json:"message"`
+	Token   Token           `json:"token"`
+	Auth    []byte          `json:"auth"`
+	Nonce   string          `json:"nonce"`
+}
+
+// Подписываемая строка: поля разделены "\n", токен и сообщение
+// закодированы, так что границы полей нельзя сдвинуть
+func (c *CmdPublish) signingString() []byte {
+	return []byte(fmt.Sprintf("%s\n%s\n%x\n%s",
+		c.Channel,
+		base64.StdEncoding.EncodeToString(c.Token.Bytes),
+		sha256.Sum256(c.Message),
+		c.Nonce,
+	))
+}
+
+// Проверяет права, токен и подпись публикации. Для JWT подпись не нужна,
+// канал должен быть разрешён для публикации в claims.
+func (c *CmdPublish) Check(conf *Conf, site *SiteConf) error {
+	if !site.CanClientPublish(c.Channel) {
+		return ErrPublishNotAllowed
+	}
+
+	claims, err := checkSiteToken(conf, site, &c.Token)
+	if err != nil {
+		return err
+	}
+
+	if claims != nil {
+		if !patternsAllow(claims.Publish, c.Channel) {
+			return ErrChannelNotAllowed
+		}
+		return nil
+	}
+
+	if !site.Secret.Verify(func(secret []byte) bool {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(c.signingString())
+		return hmac.Equal(mac.Sum(nil), c.Auth)
+	}) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+type CmdMembers struct {
+	Channel string `json:"channel"`
+}
+
 const (
 	RespStatusOK  = "ok"
 	RespStatusErr = "error"
@@ -56,42 +155,120 @@ type Map map[string]interface{}
 
 type Session struct {
 	JSONio
-	Log  *logg.Logger    `inject:""`
-	Site *SiteConf       `inject:""`
-	Conf *Conf           `inject:""`
-	Pool npool.NamedPool `inject:""`
+	Log       *logg.Logger  `inject:""`
+	Site      *SiteConf     `inject:""`
+	Confs     *ConfStore    `inject:""`
+	Broker    broker.Broker `inject:""`
+	Publisher *Publisher    `inject:""`
+	Stats     *Stats        `inject:""`
+	Metrics   *Metrics      `inject:""`
+	Sessions  *Sessions     `inject:""`
+
+	rChan    chan json.RawMessage
+	wChan    chan interface{}
+	qChan    chan struct{}
+	awayChan chan struct{}
+	awayOnce sync.Once
+
+	// Исходящая очередь сообщений каналов и событий присутствия
+	queueLk  sync.Mutex
+	queue    *ring.Ring
+	replay   []interface{} // сообщения из буфера канала, в queue_size не входят
+	overflow bool          // очередь переполнена, сессия будет закрыта
+	notify   chan struct{} // в очереди что-то появилось
+}
+
+// Код закрытия WebSocket при остановке сервера
+const CloseGoingAway = 1001
+
+// Размер исходящей очереди сессии по умолчанию
+const DefaultQueueSize = 256
+
+// Политики переполнения исходящей очереди сессии
+const (
+	SlowConsumerDropOldest = "drop_oldest"
+	SlowConsumerDropNewest = "drop_newest"
+	SlowConsumerDisconnect = "disconnect"
+)
+
+// Код закрытия WebSocket, когда клиент не успевает принимать сообщения
+// (политика slow_consumer = disconnect)
+const CloseSlowConsumer = 4008
+
+// Сколько ждать ответа клиента на закрытие соединения
+const CloseGracePeriod = 2 * time.Second
+
+// Подсказка клиенту в закрывающем кадре: переподключиться через
+// reconnect_after секунд (разброс, чтобы клиенты не пришли все разом)
+const ReconnectSpread = 5
 
-	rChan chan json.RawMessage
-	wChan chan interface{}
-	qChan chan struct{}
+// Закрывающий кадр, передаётся писателю через wChan
+type closeFrame struct {
+	code int
+	text string
+}
+
+// Соединение, которое умеет отправлять управляющие кадры и закрываться
+// (*websocket.Conn)
+type wsCloser interface {
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	Close() error
 }
 
 func NewSession(jio JSONio) *Session {
 	return &Session{
-		JSONio: jio,
-		rChan:  make(chan json.RawMessage),
-		wChan:  make(chan interface{}),
-		qChan:  make(chan struct{}),
+		JSONio:   jio,
+		rChan:    make(chan json.RawMessage),
+		wChan:    make(chan interface{}),
+		qChan:    make(chan struct{}),
+		awayChan: make(chan struct{}),
+		notify:   make(chan struct{}, 1),
 	}
 }
 
+// Просит сессию закрыться: она отписывается от каналов, дописывает
+// то, что уже отправлено писателю, и посылает клиенту закрывающий кадр
+// с кодом 1001. Не блокируется.
+func (s *Session) GoAway() {
+	s.awayOnce.Do(func() { close(s.awayChan) })
+}
+
 func (s *Session) Run() {
 	s.Log.TRACE("Session started")
 	defer s.Log.TRACE("Session closed")
 
-	atomic.AddUint32(&s.Conf.NSessions, 1)
-	defer atomic.AddUint32(&s.Conf.NSessions, ^uint32(0))
+	siteStats := s.Stats.Site(s.Site.Name)
+	atomic.AddInt64(&siteStats.Sessions, 1)
+	defer atomic.AddInt64(&siteStats.Sessions, -1)
+
+	s.queue = ring.New(s.Site.QueueSize)
+
+	s.Sessions.Add(s)
+	defer s.Sessions.Remove(s)
 
 	go s.reader()
 	go s.writer()
 
 	subscrNames := make(map[string]struct{})
+	awayChan := s.awayChan
 
 L:
 	for {
 		req := new(CmdRequest)
 		select {
+		case <-awayChan:
+			awayChan = nil
+			s.unsubscribeAll(subscrNames)
+			s.wChan <- &closeFrame{
+				code: CloseGoingAway,
+				text: fmt.Sprintf(`{"reconnect_after":%d}`, 1+rand.Intn(ReconnectSpread)),
+			}
+
 		case m := <-s.rChan:
+			if awayChan == nil {
+				// сессия закрывается, новые команды не принимаются
+				continue
+			}
 			json.Unmarshal(m, req)
 			s.Log.TRACE("Message %q => %v", req.Request, string(m))
 
@@ -100,47 +277,75 @@ L:
 				cmd := new(CmdSubscribe)
 				json.Unmarshal(req.Body, cmd)
 
-				mac := hmac.New(sha256.New, s.Site.Secret)
-				mac.Write([]byte(cmd.Channel))
-				mac.Write(cmd.Token)
-				sign := mac.Sum(nil)
-
-				if !CheckToken(cmd.Token, s.Conf.Secret) {
-					s.wChan <- req.RespErr("invalid token")
-				} else if !hmac.Equal(sign, cmd.Auth) {
-					s.wChan <- req.RespErr("invalid signature")
+				if err := cmd.Check(s.Confs.Get(), s.site()); err != nil {
+					s.Metrics.AuthFailed(s.Site.Name, err)
+					s.wChan <- req.RespErr(err.Error())
 				} else if _, ok := subscrNames[cmd.Channel]; ok {
 					s.wChan <- req.RespErr("already subscribed")
 				} else {
-					s.wChan <- req.RespOK()
+					s.wChan <- req.RespOKWith(&SubscribeResult{Epoch: channel.CurrentEpoch()})
 
-					ch := s.Pool.Get(channel.ChanKey{
+					s.Broker.Subscribe(channel.ChanKey{
 						Site: s.Site.Name,
 						Name: cmd.Channel,
-					}).(*channel.Channel)
-
-					ch.Subscribe(s, cmd.After)
+					}, s, cmd.After, channel.Presence{
+						Member: cmd.Member,
+						Notify: cmd.Presence,
+					})
 					subscrNames[cmd.Channel] = struct{}{}
 				}
 
 			case "unsubscribe":
 				cmd := new(CmdUnsubscribe)
-				json.Unmarshal(m, cmd)
+				json.Unmarshal(req.Body, cmd)
 
 				// не подписаны ли мы уже?
 				if _, ok := subscrNames[cmd.Channel]; !ok {
 					s.wChan <- req.RespErr("not subscribed")
 				} else {
-					ch := s.Pool.Get(channel.ChanKey{
+					s.Broker.Unsubscribe(channel.ChanKey{
 						Site: s.Site.Name,
 						Name: cmd.Channel,
-					}).(*channel.Channel)
-
-					ch.Unsubscribe(s)
+					}, s)
 					delete(subscrNames, cmd.Channel)
 
 					s.wChan <- req.RespOK()
 				}
+
+			case "publish":
+				cmd := new(CmdPublish)
+				json.Unmarshal(req.Body, cmd)
+
+				if err := cmd.Check(s.Confs.Get(), s.site()); err != nil {
+					s.Metrics.AuthFailed(s.Site.Name, err)
+					s.wChan <- req.RespErr(err.Error())
+				} else if len(cmd.Message) == 0 {
+					s.wChan <- req.RespErr("empty message")
+				} else if _, err := s.Publisher.Publish(s.site(), cmd.Channel, cmd.Message, cmd.Nonce, cmd.Token.Expires); err == ErrDuplicate {
+					s.wChan <- req.RespOKWith(Map{"duplicate": true})
+				} else if err == broker.ErrInvalidChannel {
+					s.wChan <- req.RespErr("invalid channel name")
+				} else if err != nil {
+					s.Log.ERROR("Can not publish message: %v", err)
+					s.wChan <- req.RespErr("can not publish message")
+				} else {
+					s.wChan <- req.RespOK()
+				}
+
+			case "members":
+				cmd := new(CmdMembers)
+				json.Unmarshal(req.Body, cmd)
+
+				if _, ok := subscrNames[cmd.Channel]; !ok {
+					s.wChan <- req.RespErr("not subscribed")
+				} else if channel.IsPattern(cmd.Channel) {
+					s.wChan <- req.RespErr("not supported for patterns")
+				} else {
+					s.wChan <- req.RespOKWith(s.Broker.Members(channel.ChanKey{
+						Site: s.Site.Name,
+						Name: cmd.Channel,
+					}))
+				}
 			}
 
 		case <-s.qChan:
@@ -148,19 +353,105 @@ L:
 		}
 	}
 
-	// Отписываемся
+	s.unsubscribeAll(subscrNames)
+}
+
+// Текущие настройки сайта сессии (конфигурация могла быть перечитана)
+func (s *Session) site() *SiteConf {
+	if site := s.Confs.Get().Site(s.Site.Name); site != nil {
+		return site
+	}
+	return s.Site
+}
+
+func (s *Session) unsubscribeAll(subscrNames map[string]struct{}) {
 	for name := range subscrNames {
-		ch := s.Pool.Get(channel.ChanKey{
+		s.Broker.Unsubscribe(channel.ChanKey{
 			Site: s.Site.Name,
 			Name: name,
-		}).(*channel.Channel)
-		ch.Unsubscribe(s)
+		}, s)
+		delete(subscrNames, name)
 	}
-
 }
 
 func (s *Session) ReceiveMessage(m *channel.Message) {
-	s.wChan <- m
+	if m.Replayed {
+		s.enqueueReplay(m)
+		return
+	}
+	s.enqueue(m)
+}
+
+func (s *Session) ReceivePresence(e *channel.PresenceEvent) { s.enqueue(e) }
+
+// Ставит сообщение в исходящую очередь, не блокируясь. Если очередь
+// полна, поступает по политике сайта slow_consumer.
+func (s *Session) enqueue(m interface{}) {
+	s.queueLk.Lock()
+	defer s.queueLk.Unlock()
+
+	if s.overflow {
+		return
+	}
+
+	if s.queue.Length() == s.queue.Size() {
+		siteStats := s.Stats.Site(s.Site.Name)
+		atomic.AddUint64(&siteStats.Dropped, 1)
+
+		switch s.Site.SlowConsumer {
+		case SlowConsumerDropNewest:
+			return
+		case SlowConsumerDisconnect:
+			s.Log.DEBUG("Outbound queue is full, disconnecting")
+			atomic.AddUint64(&siteStats.SlowDisconnects, 1)
+			s.overflow = true
+			s.queue.Clean()
+			s.replay = nil
+		default: // SlowConsumerDropOldest: Append вытесняет первый элемент
+			s.queue.Append(m)
+		}
+	} else {
+		s.queue.Append(m)
+	}
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Ставит в очередь сообщение из буфера канала, переданное при подписке.
+// Такие сообщения не ограничены queue_size (их не больше, чем помещается
+// в буфер канала) и не отбрасываются политикой slow_consumer, иначе
+// подписка с after на длинную историю никогда бы не удалась.
+func (s *Session) enqueueReplay(m *channel.Message) {
+	s.queueLk.Lock()
+	defer s.queueLk.Unlock()
+
+	if s.overflow {
+		return
+	}
+	s.replay = append(s.replay, m)
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Забирает всё из исходящей очереди. Сообщения из буфера идут первыми:
+// новые сообщения того же канала могли попасть в очередь только после них.
+func (s *Session) dequeueAll() (items []interface{}, overflow bool) {
+	s.queueLk.Lock()
+	defer s.queueLk.Unlock()
+
+	items, s.replay = s.replay, nil
+	s.queue.Each(func(_ int, v interface{}) bool {
+		items = append(items, v)
+		return true
+	})
+	s.queue.Clean()
+	return items, s.overflow
 }
 
 func (s *Session) reader() {
@@ -182,14 +473,69 @@ func (s *Session) reader() {
 }
 
 func (s *Session) writer() {
+	closed := false // закрывающий кадр отправлен, больше ничего не пишем
 	for {
 		select {
 		case <-s.qChan:
 			return
 		case m := <-s.wChan:
-			if err := s.WriteJSON(m); err != nil {
-				s.Log.DEBUG("WS write error %v", err)
+			if closed {
+				continue
+			}
+			if cf, ok := m.(*closeFrame); ok {
+				// то, что уже стоит в очереди, уходит до закрывающего кадра
+				if items, overflow := s.dequeueAll(); !overflow {
+					for _, m := range items {
+						s.write(m)
+					}
+				}
+				s.writeClose(cf)
+				closed = true
+				continue
+			}
+			s.write(m)
+		case <-s.notify:
+			items, overflow := s.dequeueAll()
+			if closed {
+				continue
+			}
+			if overflow {
+				s.writeClose(&closeFrame{code: CloseSlowConsumer, text: "slow consumer"})
+				closed = true
+				continue
+			}
+			for _, m := range items {
+				s.write(m)
 			}
 		}
 	}
 }
+
+func (s *Session) write(m interface{}) {
+	start := time.Now()
+	if err := s.WriteJSON(m); err != nil {
+		s.Log.DEBUG("WS write error %v", err)
+		return
+	}
+	s.Metrics.WSWritten(s.Site.Name, time.Since(start))
+	if msg, ok := m.(*channel.Message); ok {
+		s.Metrics.MessageWritten(s.Site.Name, msg)
+	}
+}
+
+// Посылает закрывающий кадр и закрывает соединение, если клиент не ответит
+// за CloseGracePeriod
+func (s *Session) writeClose(cf *closeFrame) {
+	conn, ok := s.JSONio.(wsCloser)
+	if !ok {
+		return
+	}
+	if err := conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(cf.code, cf.text),
+		time.Now().Add(CloseGracePeriod),
+	); err != nil {
+		s.Log.DEBUG("WS write error %v", err)
+	}
+	time.AfterFunc(CloseGracePeriod, func() { conn.Close() })
+}
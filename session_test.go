@@ -0,0 +1,197 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davidmz/halley2/internal/channel"
+	"github.com/davidmz/halley2/internal/npool"
+	"github.com/davidmz/halley2/internal/ring"
+	"github.com/davidmz/logg"
+	"github.com/stretchr/testify/require"
+)
+
+// Соединение, запоминающее всё, что в него записали
+type fakeConn struct {
+	lk     sync.Mutex
+	out    []interface{}
+	closed int // код закрывающего кадра
+}
+
+func (c *fakeConn) ReadJSON(v interface{}) error { return io.EOF }
+
+func (c *fakeConn) WriteJSON(v interface{}) error {
+	c.lk.Lock()
+	c.out = append(c.out, v)
+	c.lk.Unlock()
+	return nil
+}
+
+func (c *fakeConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	c.lk.Lock()
+	c.closed = int(data[0])<<8 | int(data[1])
+	c.lk.Unlock()
+	return nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) written() (ords []channel.Ord, closed int) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	for _, v := range c.out {
+		if m, ok := v.(*channel.Message); ok {
+			ords = append(ords, m.Ord)
+		}
+	}
+	return ords, c.closed
+}
+
+func newTestSession(policy string, queueSize int) (*Session, *fakeConn) {
+	conn := new(fakeConn)
+	s := NewSession(conn)
+	lvl, _ := logg.LevelByName("OFF")
+	s.Log = logg.New(lvl, logg.DefaultWriter)
+	s.Site = &SiteConf{Name: "site", QueueSize: queueSize, SlowConsumer: policy}
+	s.Stats = NewStats()
+	s.Metrics = NewMetrics()
+	s.queue = ring.New(queueSize)
+	return s, conn
+}
+
+func receive(s *Session, replayed bool, ords ...channel.Ord) {
+	for _, o := range ords {
+		s.ReceiveMessage(&channel.Message{Ord: o, Time: time.Now(), Replayed: replayed})
+	}
+}
+
+func dequeuedOrds(s *Session) (ords []channel.Ord, overflow bool) {
+	items, overflow := s.dequeueAll()
+	for _, v := range items {
+		ords = append(ords, v.(*channel.Message).Ord)
+	}
+	return ords, overflow
+}
+
+func TestSlowConsumerDropOldest(t *testing.T) {
+	s, _ := newTestSession(SlowConsumerDropOldest, 3)
+	receive(s, false, 1, 2, 3, 4, 5)
+
+	ords, overflow := dequeuedOrds(s)
+	require.False(t, overflow)
+	require.Equal(t, []channel.Ord{3, 4, 5}, ords)
+	require.EqualValues(t, 2, s.Stats.Site("site").Dropped)
+}
+
+func TestSlowConsumerDropNewest(t *testing.T) {
+	s, _ := newTestSession(SlowConsumerDropNewest, 3)
+	receive(s, false, 1, 2, 3, 4, 5)
+
+	ords, overflow := dequeuedOrds(s)
+	require.False(t, overflow)
+	require.Equal(t, []channel.Ord{1, 2, 3}, ords)
+	require.EqualValues(t, 2, s.Stats.Site("site").Dropped)
+}
+
+func TestSlowConsumerDisconnect(t *testing.T) {
+	s, conn := newTestSession(SlowConsumerDisconnect, 3)
+	receive(s, false, 1, 2, 3, 4, 5)
+
+	go s.writer()
+	defer close(s.qChan)
+
+	require.Eventually(t, func() bool {
+		_, closed := conn.written()
+		return closed != 0
+	}, time.Second, time.Millisecond)
+
+	ords, closed := conn.written()
+	require.Equal(t, CloseSlowConsumer, closed)
+	require.Empty(t, ords)
+	require.EqualValues(t, 1, s.Stats.Site("site").SlowDisconnects)
+
+	// после закрытия сообщения не принимаются
+	receive(s, false, 6)
+	ords, overflow := dequeuedOrds(s)
+	require.True(t, overflow)
+	require.Empty(t, ords)
+}
+
+func TestReplayOutsideQueueLimit(t *testing.T) {
+	s, _ := newTestSession(SlowConsumerDisconnect, 3)
+	receive(s, true, 1, 2, 3, 4, 5)
+	receive(s, false, 6, 7)
+
+	ords, overflow := dequeuedOrds(s)
+	require.False(t, overflow)
+	require.Equal(t, []channel.Ord{1, 2, 3, 4, 5, 6, 7}, ords)
+	require.Zero(t, s.Stats.Site("site").Dropped)
+}
+
+// Сессия, подписавшаяся посреди потока публикаций, получает сообщения из
+// буфера и новые строго по возрастанию и без пропусков
+func TestSessionDeliveryOrder(t *testing.T) {
+	const (
+		publishers = 8
+		perPub     = 300
+	)
+
+	pool := npool.New((*channel.Channel)(nil), &channel.ChanConf{
+		RingSize: publishers * perPub,
+		TTL:      time.Minute,
+	})
+	ch := pool.Get(channel.ChanKey{Site: "site", Name: "stress"}).(*channel.Channel)
+
+	var pubs sync.WaitGroup
+	errs := make(chan error, publishers)
+	for i := 0; i < publishers; i++ {
+		pubs.Add(1)
+		go func() {
+			defer pubs.Done()
+			for j := 0; j < perPub; j++ {
+				if _, err := ch.AddMessage([]byte(`1`)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	// дождёмся, пока в буфере что-то появится
+	var after channel.Ord
+	require.Eventually(t, func() bool {
+		if last := ch.History(0, 0, 1); len(last) > 0 {
+			after = last[0].Ord
+			return true
+		}
+		return false
+	}, time.Second, time.Microsecond)
+
+	s, conn := newTestSession(SlowConsumerDisconnect, publishers*perPub)
+	go s.writer()
+	defer close(s.qChan)
+	ch.Subscribe(s, after, channel.Presence{})
+
+	pubs.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	var want []channel.Ord
+	for _, m := range ch.History(0, 0, 0) {
+		if m.Ord > after {
+			want = append(want, m.Ord)
+		}
+	}
+	require.Eventually(t, func() bool {
+		ords, _ := conn.written()
+		return len(ords) >= len(want)
+	}, time.Second, time.Millisecond)
+
+	ords, closed := conn.written()
+	require.Zero(t, closed)
+	require.Equal(t, want, ords)
+}
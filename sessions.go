@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// Реестр открытых WebSocket-сессий
+type Sessions struct {
+	lk    sync.Mutex
+	items map[*Session]struct{}
+	empty chan struct{} // закрыт, когда сессий нет
+}
+
+func NewSessions() *Sessions {
+	empty := make(chan struct{})
+	close(empty)
+	return &Sessions{
+		items: make(map[*Session]struct{}),
+		empty: empty,
+	}
+}
+
+func (ss *Sessions) Add(s *Session) {
+	ss.lk.Lock()
+	defer ss.lk.Unlock()
+
+	if len(ss.items) == 0 {
+		ss.empty = make(chan struct{})
+	}
+	ss.items[s] = struct{}{}
+}
+
+func (ss *Sessions) Remove(s *Session) {
+	ss.lk.Lock()
+	defer ss.lk.Unlock()
+
+	if _, ok := ss.items[s]; !ok {
+		return
+	}
+	delete(ss.items, s)
+	if len(ss.items) == 0 {
+		close(ss.empty)
+	}
+}
+
+// Просит закрыться все сессии, для которых filter возвращает true
+// (filter = nil — все сессии)
+func (ss *Sessions) GoAway(filter func(*Session) bool) {
+	ss.lk.Lock()
+	defer ss.lk.Unlock()
+
+	for s := range ss.items {
+		if filter == nil || filter(s) {
+			s.GoAway()
+		}
+	}
+}
+
+// Ждёт, пока все сессии закроются, или истечения ctx
+func (ss *Sessions) Wait(ctx context.Context) error {
+	ss.lk.Lock()
+	empty := ss.empty
+	ss.lk.Unlock()
+
+	select {
+	case <-empty:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/davidmz/halley2/internal/broker"
+	"github.com/davidmz/halley2/internal/channel"
+	"github.com/davidmz/halley2/internal/npool"
+)
+
+// Счётчики событий для /stats
+type Stats struct {
+	lk    sync.Mutex
+	sites map[string]*SiteStats
+}
+
+// Счётчики одного сайта, изменяются атомарно
+type SiteStats struct {
+	Sessions        int64  `json:"sessions"`
+	Published       uint64 `json:"published"`
+	Delivered       uint64 `json:"delivered"`
+	Subscribes      uint64 `json:"subscribes"`
+	Unsubscribes    uint64 `json:"unsubscribes"`
+	RejectedOrigins uint64 `json:"rejected_origins"`
+	// Сообщения, не поместившиеся в исходящие очереди сессий, и сессии,
+	// закрытые из-за этого
+	Dropped         uint64 `json:"dropped"`
+	SlowDisconnects uint64 `json:"slow_disconnects"`
+}
+
+// Счётчики сайта вместе с состоянием его активных каналов
+type SiteStatsResponse struct {
+	*SiteStats
+	Channels     int `json:"channels"`
+	Subscribers  int `json:"subscribers"`
+	RingMessages int `json:"ring_messages"`
+	RingCapacity int `json:"ring_capacity"`
+}
+
+func NewStats() *Stats {
+	return &Stats{sites: make(map[string]*SiteStats)}
+}
+
+// Счётчики сайта name (создаются при первом обращении)
+func (s *Stats) Site(name string) *SiteStats {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	ss, ok := s.sites[name]
+	if !ok {
+		ss = new(SiteStats)
+		s.sites[name] = ss
+	}
+	return ss
+}
+
+// Реализует channel.DeliveryCounter
+func (s *Stats) CountDelivery(key channel.ChanKey, receivers int) {
+	atomic.AddUint64(&s.Site(key.Site).Delivered, uint64(receivers))
+}
+
+// Текущие значения счётчиков всех сайтов
+func (s *Stats) Snapshot() map[string]*SiteStats {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	res := make(map[string]*SiteStats, len(s.sites))
+	for name, ss := range s.sites {
+		res[name] = &SiteStats{
+			Sessions:        atomic.LoadInt64(&ss.Sessions),
+			Published:       atomic.LoadUint64(&ss.Published),
+			Delivered:       atomic.LoadUint64(&ss.Delivered),
+			Subscribes:      atomic.LoadUint64(&ss.Subscribes),
+			Unsubscribes:    atomic.LoadUint64(&ss.Unsubscribes),
+			RejectedOrigins: atomic.LoadUint64(&ss.RejectedOrigins),
+			Dropped:         atomic.LoadUint64(&ss.Dropped),
+			SlowDisconnects: atomic.LoadUint64(&ss.SlowDisconnects),
+		}
+	}
+	return res
+}
+
+// Счётчики всех сайтов и сводка по активным каналам пула. Для каждого
+// канала дополнительно вызывается each (если не nil).
+func (s *Stats) Report(pool npool.NamedPool, each func(*channel.ChanInfo)) map[string]*SiteStatsResponse {
+	sites := make(map[string]*SiteStatsResponse)
+	for name, ss := range s.Snapshot() {
+		sites[name] = &SiteStatsResponse{SiteStats: ss}
+	}
+
+	pool.Each(func(_, obj interface{}) {
+		info := obj.(*channel.Channel).Info()
+		ss, ok := sites[info.Key.Site]
+		if !ok {
+			ss = &SiteStatsResponse{SiteStats: new(SiteStats)}
+			sites[info.Key.Site] = ss
+		}
+		ss.Channels++
+		ss.Subscribers += info.Subscribers
+		ss.RingMessages += info.RingLength
+		ss.RingCapacity += info.RingSize
+		if each != nil {
+			each(info)
+		}
+	})
+
+	return sites
+}
+
+// Брокер, считающий подписки и отписки
+type countingBroker struct {
+	broker.Broker
+	stats *Stats
+}
+
+func (b *countingBroker) Subscribe(key channel.ChanKey, rcv channel.Receiver, after channel.Ord, p channel.Presence) {
+	b.Broker.Subscribe(key, rcv, after, p)
+	atomic.AddUint64(&b.stats.Site(key.Site).Subscribes, 1)
+}
+
+func (b *countingBroker) Unsubscribe(key channel.ChanKey, rcv channel.Receiver) {
+	b.Broker.Unsubscribe(key, rcv)
+	atomic.AddUint64(&b.stats.Site(key.Site).Unsubscribes, 1)
+}